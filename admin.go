@@ -0,0 +1,88 @@
+package request_decompressor
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	caddy.RegisterModule(adminMetrics{})
+}
+
+// adminMetrics provides the /request_decompress/metrics endpoints of the
+// admin API, for reading the metrics of every provisioned handler as JSON
+// and resetting them without a Prometheus setup.
+type adminMetrics struct{}
+
+// CaddyModule returns the Caddy module information.
+func (adminMetrics) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.request_decompress",
+		New: func() caddy.Module { return new(adminMetrics) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a adminMetrics) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/request_decompress/metrics",
+			Handler: caddy.AdminHandlerFunc(a.handleMetrics),
+		},
+		{
+			Pattern: "/request_decompress/metrics/reset",
+			Handler: caddy.AdminHandlerFunc(a.handleReset),
+		},
+	}
+}
+
+// handleMetrics responds with the metrics of all live handlers added up.
+func (adminMetrics) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        errors.New("method not allowed"),
+		}
+	}
+
+	snapshot := metricsSnapshot{
+		RequestsByEncoding: make(map[string]int64),
+		SecondsByEncoding:  make(map[string]float64),
+		FailuresByReason:   make(map[string]int64),
+	}
+	liveMetrics.Range(func(key, _ any) bool {
+		key.(*DecompressionMetrics).addTo(&snapshot)
+		return true
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// handleReset zeroes the metrics of all live handlers.
+func (adminMetrics) handleReset(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        errors.New("method not allowed"),
+		}
+	}
+
+	liveMetrics.Range(func(key, _ any) bool {
+		key.(*DecompressionMetrics).reset()
+		return true
+	})
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// liveMetrics holds the metrics of every provisioned handler that hasn't
+// been cleaned up yet, so the admin API can find them.
+var liveMetrics sync.Map
+
+// Interface guard
+var _ caddy.AdminRouter = (*adminMetrics)(nil)
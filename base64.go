@@ -0,0 +1,60 @@
+//go:build !minimal && !nobase64
+
+package request_decompressor
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+func init() {
+	registerDecoder("base64", func(*Middleware) (decodeFunc, error) {
+		return decodeBase64, nil
+	})
+}
+
+// decodeBase64 decodes a base64 body. It isn't a compression but a
+// transfer transform that legacy clients chain with one, as in
+// "gzip, base64" for a gzip body that was then base64-encoded. The
+// standard and URL-safe alphabets are both accepted, with or without
+// padding, and line breaks are ignored.
+func decodeBase64(src io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(base64.NewDecoder(base64.RawStdEncoding, &base64Normalizer{Reader: src})), nil
+}
+
+// base64Normalizer turns base64 in either alphabet into unpadded standard
+// base64, dropping whitespace. Padding may only end the data.
+type base64Normalizer struct {
+	io.Reader
+	padded bool
+}
+
+// Read implements io.Reader.
+func (b *base64Normalizer) Read(p []byte) (int, error) {
+	for {
+		n, err := b.Reader.Read(p)
+		kept := 0
+		for _, c := range p[:n] {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+				continue
+			case '=':
+				b.padded = true
+				continue
+			case '-':
+				c = '+'
+			case '_':
+				c = '/'
+			}
+			if b.padded {
+				return 0, errors.New("base64: data after padding")
+			}
+			p[kept] = c
+			kept++
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
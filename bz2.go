@@ -0,0 +1,23 @@
+//go:build !minimal && !nobz2
+
+package request_decompressor
+
+import (
+	"compress/bzip2"
+	"io"
+)
+
+func init() {
+	registerDecoder("bz2", func(*Middleware) (decodeFunc, error) {
+		return func(src io.Reader) (io.ReadCloser, error) {
+			// "BZh" and the block size in hundreds of kB, 1-9.
+			src, err := checkMagic(src, 4, func(magic []byte) bool {
+				return string(magic[:3]) == "BZh" && magic[3] >= '1' && magic[3] <= '9'
+			})
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(bzip2.NewReader(src)), nil
+		}, nil
+	})
+}
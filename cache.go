@@ -0,0 +1,116 @@
+package request_decompressor
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultCacheTTL is how long a decompressed body is cached when
+// CacheIdempotentTTL isn't set. Retries come within seconds, so bodies
+// needn't be held for long.
+const defaultCacheTTL = time.Minute
+
+// cacheEntryOverhead is what each cached body is counted as on top of its
+// length, for the key and bookkeeping, so that many tiny bodies can't grow
+// the cache past its size either.
+const cacheEntryOverhead = 128
+
+// cacheKey identifies a body by its Idempotency-Key, its encodings and a
+// hash of the compressed bytes, so a retry that reuses the key for a
+// different body is decoded afresh.
+type cacheKey [sha256.Size]byte
+
+func newCacheKey(idempotencyKey string, encodings []string, compressed []byte) cacheKey {
+	h := sha256.New()
+	// The key and encodings are header values, which can't contain NUL.
+	h.Write([]byte(idempotencyKey))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.Join(encodings, ",")))
+	h.Write([]byte{0})
+	h.Write(compressed)
+	var key cacheKey
+	h.Sum(key[:0])
+	return key
+}
+
+// decodeCache holds recently decompressed bodies, up to maxBytes in total,
+// evicting the least recently used first.
+type decodeCache struct {
+	maxBytes int64
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	order   *list.List // most recently used at the front
+	size    int64
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	body    []byte
+	expires time.Time
+}
+
+func newDecodeCache(maxBytes int64, ttl time.Duration) *decodeCache {
+	return &decodeCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[cacheKey]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// get returns the body cached under key, if it hasn't expired. The body
+// is shared and must not be modified.
+func (c *decodeCache) get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.body, true
+}
+
+// put caches body under key, making room by evicting the least recently
+// used bodies. Bodies larger than the whole cache aren't kept. Expired ones
+// are left until they are looked up or evicted, which the size limit
+// bounds. body must not be modified afterwards.
+func (c *decodeCache) put(key cacheKey, body []byte) {
+	size := entrySize(body)
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.size+size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, body: body, expires: time.Now().Add(c.ttl)})
+	c.size += size
+}
+
+func (c *decodeCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entrySize(entry.body)
+}
+
+func entrySize(body []byte) int64 {
+	return int64(len(body)) + cacheEntryOverhead
+}
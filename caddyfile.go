@@ -0,0 +1,563 @@
+package request_decompressor
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
+)
+
+func init() {
+	httpcaddyfile.RegisterHandlerDirective("request_decompress", parseCaddyfile)
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+//
+//	request_decompress {
+//	    observe
+//	    inspect_only
+//	    retain_original
+//	    sample_rate <fraction>
+//	    tee_to <url|path>
+//	    peel_one
+//	    legacy_base64_order
+//	    stream
+//	    max_size <size>
+//	    trust_size_header [<name>]
+//	    trust_decode_query [<name>]
+//	    max_compressed_size <size>
+//	    min_size <size>
+//	    max_ratio <ratio>
+//	    max_encoding_layers <n>
+//	    encodings <encodings...>
+//	    sniff
+//	    grpc_web
+//	    multipart
+//	    match_path <patterns...>
+//	    methods <methods...>
+//	    content_types <types...>
+//	    skip_content_types <types...>
+//	    require_header <name>
+//	    encoding_header <name>
+//	    preserve_encoding_header [<name>]
+//	    signal_header [<name>]
+//	    on_unsupported reject|passthrough
+//	    partial_chain reject|passthrough
+//	    on_oversize reject|truncate
+//	    buffer_size <size>
+//	    force_chunked
+//	    recompress_to <encoding>
+//	    error_format caddy|json
+//	    gzip_errors
+//	    error_status <code>
+//	    validate_utf8
+//	    validate_json
+//	    json_prefix
+//	    verify_uncompressed_length [<name>]
+//	    max_concurrent <n>
+//	    concurrency_timeout <duration>
+//	    decompress_timeout <duration>
+//	    rate_limit_per_ip <rate>
+//	    trusted_proxies <ranges...>
+//	    cache_idempotent <size> [<ttl>]
+//	    gzip_multistream on|off
+//	    zstd_dict <path>
+//	    zstd_concurrency <n>
+//	    deflate_dict <path>
+//	    compress_response [<encodings...>]
+//	    debug
+//	    <encoding> on|off
+//	}
+func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume directive name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "observe":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Observe = true
+
+		case "inspect_only":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.InspectOnly = true
+
+		case "retain_original":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.RetainOriginal = true
+
+		case "sample_rate":
+			var rateStr string
+			if !d.AllArgs(&rateStr) {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(rateStr, 64)
+			if err != nil {
+				return d.Errf("parsing sample_rate: %v", err)
+			}
+			m.SampleRate = rate
+
+		case "tee_to":
+			if !d.AllArgs(&m.TeeTo) {
+				return d.ArgErr()
+			}
+
+		case "peel_one":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.PeelOne = true
+
+		case "legacy_base64_order":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.LegacyBase64Order = true
+
+		case "stream":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Stream = true
+
+		case "max_size":
+			var sizeStr string
+			if !d.AllArgs(&sizeStr) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(sizeStr)
+			if err != nil {
+				return d.Errf("parsing max_size: %v", err)
+			}
+			m.MaxDecompressedSize = int64(size)
+
+		case "max_compressed_size":
+			var sizeStr string
+			if !d.AllArgs(&sizeStr) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(sizeStr)
+			if err != nil {
+				return d.Errf("parsing max_compressed_size: %v", err)
+			}
+			m.MaxCompressedSize = int64(size)
+
+		case "sniff":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Sniff = true
+
+		case "multipart":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Multipart = true
+
+		case "grpc_web":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.GRPCWeb = true
+
+		case "max_ratio":
+			var ratioStr string
+			if !d.AllArgs(&ratioStr) {
+				return d.ArgErr()
+			}
+			ratio, err := strconv.ParseFloat(ratioStr, 64)
+			if err != nil {
+				return d.Errf("parsing max_ratio: %v", err)
+			}
+			m.MaxRatio = ratio
+
+		case "max_encoding_layers":
+			var layersStr string
+			if !d.AllArgs(&layersStr) {
+				return d.ArgErr()
+			}
+			layers, err := strconv.Atoi(layersStr)
+			if err != nil {
+				return d.Errf("parsing max_encoding_layers: %v", err)
+			}
+			m.MaxEncodingLayers = layers
+
+		case "min_size":
+			var sizeStr string
+			if !d.AllArgs(&sizeStr) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(sizeStr)
+			if err != nil {
+				return d.Errf("parsing min_size: %v", err)
+			}
+			m.MinSize = int64(size)
+
+		case "match_path":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			m.MatchPath = append(m.MatchPath, args...)
+
+		case "methods":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				m.Methods = append(m.Methods, strings.ToUpper(arg))
+			}
+
+		case "content_types":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				m.ContentTypes = append(m.ContentTypes, strings.ToLower(arg))
+			}
+
+		case "skip_content_types":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				m.SkipContentTypes = append(m.SkipContentTypes, strings.ToLower(arg))
+			}
+
+		case "require_header":
+			if !d.AllArgs(&m.RequireHeader) {
+				return d.ArgErr()
+			}
+
+		case "trust_size_header":
+			m.TrustSizeHeader = defaultTrustSizeHeader
+			if d.NextArg() {
+				m.TrustSizeHeader = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "trust_decode_query":
+			m.TrustDecodeQuery = defaultDecodeQuery
+			if d.NextArg() {
+				m.TrustDecodeQuery = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "signal_header":
+			m.SignalHeader = defaultSignalHeader
+			if d.NextArg() {
+				m.SignalHeader = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "encoding_header":
+			if !d.AllArgs(&m.EncodingHeader) {
+				return d.ArgErr()
+			}
+
+		case "preserve_encoding_header":
+			m.PreserveEncodingHeader = defaultPreserveEncodingHeader
+			if d.NextArg() {
+				m.PreserveEncodingHeader = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "on_unsupported":
+			if !d.AllArgs(&m.OnUnsupported) {
+				return d.ArgErr()
+			}
+			if m.OnUnsupported != unsupportedReject && m.OnUnsupported != unsupportedPassthrough {
+				return d.Errf("on_unsupported must be '%s' or '%s'", unsupportedReject, unsupportedPassthrough)
+			}
+
+		case "partial_chain":
+			if !d.AllArgs(&m.PartialChain) {
+				return d.ArgErr()
+			}
+			if m.PartialChain != partialChainReject && m.PartialChain != partialChainPassthrough {
+				return d.Errf("partial_chain must be '%s' or '%s'", partialChainReject, partialChainPassthrough)
+			}
+
+		case "on_oversize":
+			if !d.AllArgs(&m.OnOversize) {
+				return d.ArgErr()
+			}
+			if m.OnOversize != oversizeReject && m.OnOversize != oversizeTruncate {
+				return d.Errf("on_oversize must be '%s' or '%s'", oversizeReject, oversizeTruncate)
+			}
+
+		case "buffer_size":
+			var sizeStr string
+			if !d.AllArgs(&sizeStr) {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(sizeStr)
+			if err != nil {
+				return d.Errf("parsing buffer_size: %v", err)
+			}
+			if size == 0 {
+				return d.Errf("buffer_size must be positive")
+			}
+			m.BufferSize = int64(size)
+
+		case "force_chunked":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ForceChunked = true
+
+		case "compress_response":
+			m.CompressResponse = d.RemainingArgs()
+			if len(m.CompressResponse) == 0 {
+				m.CompressResponse = responseEncodings()
+			}
+			for i, encoding := range m.CompressResponse {
+				m.CompressResponse[i], _ = parseEncoding(encoding)
+			}
+
+		case "debug":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Debug = true
+
+		case "recompress_to":
+			var encoding string
+			if !d.AllArgs(&encoding) {
+				return d.ArgErr()
+			}
+			m.RecompressTo, _ = parseEncoding(encoding)
+
+		case "error_format":
+			if !d.AllArgs(&m.ErrorFormat) {
+				return d.ArgErr()
+			}
+			if m.ErrorFormat != errorFormatCaddy && m.ErrorFormat != errorFormatJSON {
+				return d.Errf("error_format must be '%s' or '%s'", errorFormatCaddy, errorFormatJSON)
+			}
+
+		case "gzip_errors":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.GzipErrors = true
+
+		case "error_status":
+			var statusStr string
+			if !d.AllArgs(&statusStr) {
+				return d.ArgErr()
+			}
+			status, err := strconv.Atoi(statusStr)
+			if err != nil {
+				return d.Errf("parsing error_status: %v", err)
+			}
+			m.ErrorStatus = status
+
+		case "validate_utf8":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ValidateUTF8 = true
+
+		case "validate_json":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ValidateJSON = true
+
+		case "json_prefix":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.JSONPrefix = true
+
+		case "verify_uncompressed_length":
+			m.VerifyUncompressedLength = defaultVerifyLengthHeader
+			if d.NextArg() {
+				m.VerifyUncompressedLength = d.Val()
+			}
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+
+		case "max_concurrent":
+			var limitStr string
+			if !d.AllArgs(&limitStr) {
+				return d.ArgErr()
+			}
+			limit, err := strconv.Atoi(limitStr)
+			if err != nil {
+				return d.Errf("parsing max_concurrent: %v", err)
+			}
+			m.MaxConcurrent = limit
+
+		case "concurrency_timeout":
+			var timeoutStr string
+			if !d.AllArgs(&timeoutStr) {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(timeoutStr)
+			if err != nil {
+				return d.Errf("parsing concurrency_timeout: %v", err)
+			}
+			m.ConcurrencyTimeout = caddy.Duration(timeout)
+
+		case "decompress_timeout":
+			var timeoutStr string
+			if !d.AllArgs(&timeoutStr) {
+				return d.ArgErr()
+			}
+			timeout, err := caddy.ParseDuration(timeoutStr)
+			if err != nil {
+				return d.Errf("parsing decompress_timeout: %v", err)
+			}
+			m.DecompressTimeout = caddy.Duration(timeout)
+
+		case "rate_limit_per_ip":
+			var rateStr string
+			if !d.AllArgs(&rateStr) {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(rateStr, 64)
+			if err != nil {
+				return d.Errf("parsing rate_limit_per_ip: %v", err)
+			}
+			m.RateLimitPerIP = rate
+
+		case "trusted_proxies":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				if arg == "private_ranges" {
+					m.TrustedProxies = append(m.TrustedProxies, caddyhttp.PrivateRangesCIDR()...)
+					continue
+				}
+				m.TrustedProxies = append(m.TrustedProxies, arg)
+			}
+
+		case "cache_idempotent":
+			args := d.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return d.ArgErr()
+			}
+			size, err := humanize.ParseBytes(args[0])
+			if err != nil {
+				return d.Errf("parsing cache_idempotent size: %v", err)
+			}
+			m.CacheIdempotentSize = int64(size)
+			if len(args) == 2 {
+				ttl, err := caddy.ParseDuration(args[1])
+				if err != nil {
+					return d.Errf("parsing cache_idempotent TTL: %v", err)
+				}
+				m.CacheIdempotentTTL = caddy.Duration(ttl)
+			}
+
+		case "gzip_multistream":
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			if value != "on" && value != "off" {
+				return d.Errf("gzip_multistream must be 'on' or 'off'")
+			}
+			multistream := value == "on"
+			m.GzipMultistream = &multistream
+
+		case "zstd_dict":
+			if !d.AllArgs(&m.ZstdDict) {
+				return d.ArgErr()
+			}
+
+		case "zstd_concurrency":
+			var concurrencyStr string
+			if !d.AllArgs(&concurrencyStr) {
+				return d.ArgErr()
+			}
+			concurrency, err := strconv.Atoi(concurrencyStr)
+			if err != nil {
+				return d.Errf("parsing zstd_concurrency: %v", err)
+			}
+			if concurrency < 1 {
+				return d.Errf("zstd_concurrency must be at least 1, got %d", concurrency)
+			}
+			m.ZstdConcurrency = concurrency
+
+		case "deflate_dict":
+			if !d.AllArgs(&m.DeflateDict) {
+				return d.ArgErr()
+			}
+
+		case "encodings":
+			args := d.RemainingArgs()
+			if len(args) == 0 {
+				return d.ArgErr()
+			}
+			for _, arg := range args {
+				encoding, _ := parseEncoding(arg)
+				m.AllowedEncodings = append(m.AllowedEncodings, encoding)
+			}
+
+		default:
+			name := d.Val()
+			encoding, _ := parseEncoding(name)
+			if !slices.Contains(builtinEncodings, encoding) {
+				return d.Errf("unrecognized request_decompress subdirective '%s'", name)
+			}
+			var value string
+			if !d.AllArgs(&value) {
+				return d.ArgErr()
+			}
+			if value != "on" && value != "off" {
+				return d.Errf("%s must be 'on' or 'off'", name)
+			}
+			if m.EncodingToggles == nil {
+				m.EncodingToggles = make(map[string]bool)
+			}
+			m.EncodingToggles[encoding] = value == "on"
+		}
+	}
+	return nil
+}
+
+// parseCaddyfile parses the request_decompress directive
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	var m Middleware
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return &m, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Middleware)(nil)
+	_ caddy.Validator             = (*Middleware)(nil)
+	_ caddy.CleanerUpper          = (*Middleware)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
+	_ caddyfile.Unmarshaler       = (*Middleware)(nil)
+)
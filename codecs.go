@@ -0,0 +1,98 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// decodeFunc returns a reader that decompresses src. Closing the reader
+// releases the decoder but not src.
+type decodeFunc func(src io.Reader) (io.ReadCloser, error)
+
+// A decoderFactory sets up the decoder of one encoding for a handler that
+// is being provisioned.
+type decoderFactory func(m *Middleware) (decodeFunc, error)
+
+// encodeFunc returns a writer that compresses to dst. The data is only
+// complete once the writer is closed.
+type encodeFunc func(dst io.Writer) (io.WriteCloser, error)
+
+var (
+	decoderFactories = make(map[string]decoderFactory)
+	encoders         = make(map[string]encodeFunc)
+)
+
+// builtinEncodings lists the encodings compiled into this build, which
+// newDecoder can decode.
+var builtinEncodings []string
+
+// recompressEncodings lists the encodings a body can be re-encoded to.
+// bzip2 is never among them because Go has no bzip2 encoder.
+var recompressEncodings []string
+
+// registerDecoder makes encoding decodable. Each codec registers itself
+// from an init function in its own file, which build tags can leave out.
+func registerDecoder(encoding string, factory decoderFactory) {
+	decoderFactories[encoding] = factory
+	builtinEncodings = append(builtinEncodings, encoding)
+	slices.Sort(builtinEncodings)
+}
+
+// registerEncoder makes encoding available to recompress_to and, if it is
+// among responseEncodings, to compress_response.
+func registerEncoder(encoding string, encode encodeFunc) {
+	encoders[encoding] = encode
+	recompressEncodings = append(recompressEncodings, encoding)
+	slices.Sort(recompressEncodings)
+}
+
+// gzip and identity are always built in.
+func init() {
+	registerDecoder("gzip", func(m *Middleware) (decodeFunc, error) {
+		multistream := m.GzipMultistream == nil || *m.GzipMultistream
+		return func(src io.Reader) (io.ReadCloser, error) {
+			zr, err := getGzipReader(src, multistream)
+			if err != nil {
+				return nil, err
+			}
+			if m.metrics != nil {
+				zr.onDone = m.metrics.recordGzipMembers
+			}
+			return zr, nil
+		}, nil
+	})
+	registerEncoder("gzip", func(dst io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(dst), nil
+	})
+
+	registerDecoder("identity", func(*Middleware) (decodeFunc, error) {
+		return func(src io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(src), nil
+		}, nil
+	})
+}
+
+// checkMagic reads the first n bytes of src and fails unless valid accepts
+// them, so a body that isn't in the format at all is rejected when its
+// decoder is built rather than on some later read. The returned reader
+// still yields those bytes. An empty src is passed through for the decoder
+// to judge. Errors reading src itself are returned as they are, without a
+// reason, so that the handler can tell a client that went away or timed
+// out from a malformed header.
+func checkMagic(src io.Reader, n int, valid func(magic []byte) bool) (io.Reader, error) {
+	magic := make([]byte, n)
+	got, err := io.ReadFull(src, magic)
+	switch {
+	case got == 0 && err == io.EOF:
+		return src, nil
+	case err != nil && !errors.Is(err, io.ErrUnexpectedEOF):
+		return nil, err
+	case err != nil || !valid(magic):
+		return nil, fmt.Errorf("unrecognized magic number %x", magic[:got])
+	}
+	return io.MultiReader(bytes.NewReader(magic), src), nil
+}
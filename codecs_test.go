@@ -0,0 +1,196 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+// samplePlain is the body tests encode, unless they need a particular one.
+var samplePlain = bytes.Repeat([]byte("hello world "), 20)
+
+// bz2Sample is samplePlain compressed with bzip2, since Go has no bzip2
+// encoder.
+const bz2Sample = "425a6839314159265359db48538500003191804000064490802000508604052a8cca3c26130984e9349a4e89f134984fc5dc914e142436d214e140"
+
+// TestDecodeErrorReason checks that a body in some other format is
+// reported as a bad header and a cut-off one as a bad stream, for the
+// codecs whose decoders read their header lazily.
+func TestDecodeErrorReason(t *testing.T) {
+	gzipped := encodeSample(t, "gzip", samplePlain)
+
+	for _, encoding := range []string{"bz2", "deflate", "lz4", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			if decoderFactories[encoding] == nil {
+				t.Skipf("%s is not built in", encoding)
+			}
+			encoded := encodeSample(t, encoding, samplePlain)
+			m := provisionTest(t, &Middleware{})
+
+			if got := decodeErrorOf(t, m, encoding, encoded); got != "" {
+				t.Errorf("valid body: got %s %q, want none", decodeErrorHeader, got)
+			}
+			if got := decodeErrorOf(t, m, encoding, gzipped); got != "bad_header" {
+				t.Errorf("gzip body: got %s %q, want %q", decodeErrorHeader, got, "bad_header")
+			}
+			if got := decodeErrorOf(t, m, encoding, encoded[:len(encoded)/2]); got != "bad_stream" {
+				t.Errorf("truncated body: got %s %q, want %q", decodeErrorHeader, got, "bad_stream")
+			}
+		})
+	}
+}
+
+// TestMagicReadError checks that failing to read the body while its magic
+// number is checked is put down to the client, not to a malformed header.
+func TestMagicReadError(t *testing.T) {
+	for _, encoding := range []string{"bz2", "lz4", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			if decoderFactories[encoding] == nil {
+				t.Skipf("%s is not built in", encoding)
+			}
+			encoded := encodeSample(t, encoding, samplePlain)
+			h, next := newTestHandler(t, &Middleware{})
+			body := &brokenBody{data: encoded[:2], err: errors.New("connection reset by peer")}
+			w := postBody(h, encoding, body)
+			if next.calls() != 0 {
+				t.Error("next handler called")
+			}
+			if w.Code != statusClientClosedRequest {
+				t.Errorf("got status %d, want %d", w.Code, statusClientClosedRequest)
+			}
+			if got := w.Header().Get(decodeErrorHeader); got != "" {
+				t.Errorf("got %s %q, want none", decodeErrorHeader, got)
+			}
+		})
+	}
+}
+
+// TestGzipMultistream checks that a body of three concatenated gzip
+// members is decoded in full by default and only up to the end of the
+// first member with gzip_multistream off, and that the members decoded
+// are counted.
+func TestGzipMultistream(t *testing.T) {
+	members := [][]byte{[]byte("first member, "), []byte("second member, "), []byte("third member")}
+	var body []byte
+	for _, member := range members {
+		body = append(body, encodeSample(t, "gzip", member)...)
+	}
+
+	on, off := true, false
+	tests := []struct {
+		name        string
+		multistream *bool
+		want        []byte
+		wantMembers int64
+	}{
+		{"default", nil, bytes.Join(members, nil), 3},
+		{"on", &on, bytes.Join(members, nil), 3},
+		{"off", &off, members[0], 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Middleware{GzipMultistream: tt.multistream}
+			h, next := newTestHandler(t, m)
+			if w := postBody(h, "gzip", bytes.NewReader(body)); w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := next.last().body; !bytes.Equal(got, tt.want) {
+				t.Errorf("got body %q, want %q", got, tt.want)
+			}
+			if got := snapshot(m).GzipMembers; got != tt.wantMembers {
+				t.Errorf("got %d gzip members, want %d", got, tt.wantMembers)
+			}
+		})
+	}
+}
+
+// brokenBody yields data and then fails with err, like a request body
+// whose connection broke.
+type brokenBody struct {
+	data []byte
+	err  error
+}
+
+func (b *brokenBody) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+// encodeSample encodes data as encoding, which may be any built-in
+// encoding. Go has no bzip2 encoder, so bz2 only takes samplePlain.
+func encodeSample(tb testing.TB, encoding string, data []byte) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "identity":
+		return data
+	case "bz2":
+		if !bytes.Equal(data, samplePlain) {
+			tb.Fatal("bz2 samples can only be made of samplePlain")
+		}
+		encoded, _ := hex.DecodeString(bz2Sample)
+		return encoded
+	case "compress":
+		return lzwLiterals(tb, data)
+	case "base64":
+		w = base64.NewEncoder(base64.StdEncoding, &buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	default:
+		w, err = encoders[encoding](&buf)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// lzwLiterals encodes data in the Unix compress format as one 9-bit code
+// per byte, never referring back to the table. It is valid as long as the
+// code width doesn't grow, so data is limited to 255 bytes.
+func lzwLiterals(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	if len(data) > 255 {
+		tb.Fatal("compress samples are limited to 255 bytes")
+	}
+	out := []byte{0x1f, 0x9d, 0x80 | 16} // block mode, codes of up to 16 bits
+	var bits uint32
+	var n uint
+	for _, c := range data {
+		bits |= uint32(c) << n
+		for n += 9; n >= 8; n -= 8 {
+			out = append(out, byte(bits))
+			bits >>= 8
+		}
+	}
+	if n > 0 {
+		out = append(out, byte(bits))
+	}
+	return out
+}
+
+// decodeErrorOf sends body encoded as encoding through m and returns the
+// X-Decompress-Error header of the response.
+func decodeErrorOf(t *testing.T, m *Middleware, encoding string, body []byte) string {
+	t.Helper()
+	w := postBody(m.WithNext(new(recordingHandler)), encoding, bytes.NewReader(body))
+	return w.Header().Get(decodeErrorHeader)
+}
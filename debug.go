@@ -0,0 +1,52 @@
+package request_decompressor
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Response trailers sent with Debug for requests that were decompressed.
+const (
+	trailerRatio    = "X-Decompress-Ratio"
+	trailerDuration = "X-Decompress-Duration-Ms"
+)
+
+// decodeStats is the outcome of a successful decode, for the debug
+// trailers. It stays zero until the body has been decoded, which for a
+// streamed body happens while the next handler reads it.
+type decodeStats struct {
+	done             bool
+	compressedSize   int64
+	decompressedSize int64
+	elapsed          time.Duration
+}
+
+func (s *decodeStats) set(compressedSize, decompressedSize int64, elapsed time.Duration) {
+	*s = decodeStats{done: true, compressedSize: compressedSize, decompressedSize: decompressedSize, elapsed: elapsed}
+}
+
+// serveDecoded passes a decompressed request on to next. With Debug set,
+// it announces the debug trailers before the response is written and
+// fills them in from stats once next returns, if the decode finished.
+func (m *Middleware) serveDecoded(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, stats *decodeStats) error {
+	if !m.Debug {
+		return next.ServeHTTP(w, r)
+	}
+	header := w.Header()
+	header.Add("Trailer", trailerRatio)
+	header.Add("Trailer", trailerDuration)
+
+	err := next.ServeHTTP(w, r)
+	if stats.done {
+		var ratio float64
+		if stats.compressedSize > 0 {
+			ratio = float64(stats.decompressedSize) / float64(stats.compressedSize)
+		}
+		header.Set(trailerRatio, strconv.FormatFloat(ratio, 'f', 2, 64))
+		header.Set(trailerDuration, strconv.FormatFloat(float64(stats.elapsed.Microseconds())/1000, 'f', 3, 64))
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package request_decompressor
+
+import (
+	"errors"
+	"io"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// An Option configures Decompress.
+type Option func(*decompressOptions)
+
+type decompressOptions struct {
+	config  Middleware
+	maxSize int64
+}
+
+// WithMaxSize makes reading fail once more than n bytes have been
+// decompressed. The default, 0, is no limit.
+func WithMaxSize(n int64) Option {
+	return func(o *decompressOptions) { o.maxSize = n }
+}
+
+// WithGzipMultistream sets whether gzip bodies made of several members are
+// decoded in full (the default) or end after the first member.
+func WithGzipMultistream(multistream bool) Option {
+	return func(o *decompressOptions) { o.config.GzipMultistream = &multistream }
+}
+
+// WithZstdDict decodes zstd with the dictionary in the file at path.
+func WithZstdDict(path string) Option {
+	return func(o *decompressOptions) { o.config.ZstdDict = path }
+}
+
+// WithDeflateDict decodes deflate with the preset dictionary in the file
+// at path.
+func WithDeflateDict(path string) Option {
+	return func(o *decompressOptions) { o.config.DeflateDict = path }
+}
+
+// WithLegacyBase64Order takes a base64 coding listed first in encoding to
+// have been applied last, as Middleware.LegacyBase64Order does.
+func WithLegacyBase64Order() Option {
+	return func(o *decompressOptions) { o.config.LegacyBase64Order = true }
+}
+
+// WithDecoderFactory is asked for the decoder of every encoding before the
+// built-in decoders are, as Middleware.DecoderFactory is.
+func WithDecoderFactory(factory func(encoding string, r io.Reader) (io.ReadCloser, error)) Option {
+	return func(o *decompressOptions) { o.config.DecoderFactory = factory }
+}
+
+// Decompress returns a reader that decodes r according to encoding, a
+// Content-Encoding value that may list several codings in the order they
+// were applied, such as "gzip, base64". An empty encoding returns r as it
+// is. The reader is built like the one the handler reads a whole body
+// through, but nothing else the handler does applies: no sniffing,
+// max_ratio, timeouts or metrics. Closing the reader releases the decoders
+// but not r. Codings that aren't built in fail with an error wrapping
+// ErrUnsupportedEncoding.
+func Decompress(encoding string, r io.Reader, opts ...Option) (io.ReadCloser, error) {
+	var o decompressOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	encodings := parseContentEncoding(encoding)
+	if len(encodings) == 0 {
+		return io.NopCloser(r), nil
+	}
+	if o.config.LegacyBase64Order {
+		encodings = legacyBase64Order(encodings)
+	}
+
+	// Only the decoders the chain needs are set up.
+	m := &o.config
+	m.decoders = make(map[string]decodeFunc, len(encodings))
+	for _, encoding := range encodings {
+		factory, ok := decoderFactories[encoding]
+		if _, done := m.decoders[encoding]; done || !ok {
+			continue
+		}
+		decode, err := factory(m)
+		if err != nil {
+			return nil, err
+		}
+		m.decoders[encoding] = decode
+	}
+
+	compressed := &countingReader{Reader: r}
+	body, err := m.newBodyDecoder(encodings, compressed, compressed, decodeLimits{maxSize: o.maxSize})
+	if err != nil {
+		return nil, err
+	}
+	return &plainErrorReader{ReadCloser: body}, nil
+}
+
+// decodeLimits are the bounds newBodyDecoder puts on a decoded body.
+type decodeLimits struct {
+	maxSize    int64 // 0 for no limit
+	truncate   bool  // end the body at maxSize instead of failing
+	maxRatio   float64
+	jsonPrefix bool // end the body after its first JSON value
+}
+
+// bodyDecoder reads a body through its decoders and limits.
+type bodyDecoder struct {
+	io.ReadCloser
+	prefix  *jsonPrefixReader  // nil unless limits.jsonPrefix
+	limited *sizeLimitedReader // nil without limits.maxSize
+}
+
+// newBodyDecoder returns a reader that undoes encodings on src, bounded by
+// limits. compressed counts the encoded bytes read for maxRatio; it is
+// usually src itself. Decompress and the handler's whole-body path both
+// use it; gRPC messages and multipart parts are decoded on their own.
+func (m *Middleware) newBodyDecoder(encodings []string, src io.Reader, compressed *countingReader, limits decodeLimits) (*bodyDecoder, error) {
+	decoder, err := m.newDecoderChain(encodings, src)
+	if err != nil {
+		return nil, err
+	}
+	body := &bodyDecoder{}
+	if limits.jsonPrefix {
+		body.prefix = &jsonPrefixReader{ReadCloser: decoder}
+		decoder = body.prefix
+	}
+	if limits.maxSize > 0 {
+		body.limited = &sizeLimitedReader{ReadCloser: decoder, limit: limits.maxSize, truncate: limits.truncate}
+		decoder = body.limited
+	}
+	if limits.maxRatio > 0 {
+		decoder = &ratioLimitedReader{ReadCloser: decoder, compressed: compressed, maxRatio: limits.maxRatio}
+	}
+	body.ReadCloser = decoder
+	return body, nil
+}
+
+// plainErrorReader strips the HTTP status from errors meant for the
+// handler, which mean nothing to callers of Decompress.
+type plainErrorReader struct {
+	io.ReadCloser
+}
+
+// Read implements io.Reader.
+func (p *plainErrorReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) {
+		err = handlerErr.Err
+	}
+	return n, err
+}
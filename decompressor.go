@@ -1,41 +1,419 @@
 package request_decompressor
 
 import (
+	"bufio"
 	"bytes"
-	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand/v2"
+	"mime"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/caddyserver/caddy/v2"
-	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
-	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
-	"github.com/klauspost/compress/zstd"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
 )
 
 func init() {
 	caddy.RegisterModule(Middleware{})
-	httpcaddyfile.RegisterHandlerDirective("request_decompress", parseCaddyfile)
 }
 
-// Middleware implements an HTTP handler that decompresses request bodies
+// Middleware implements an HTTP handler that decompresses request bodies.
+// In JSON config it is the "request_decompressor" handler, and its fields
+// use the same names as the Caddyfile options.
 type Middleware struct {
-	logger *zap.Logger
-	metrics *DecompressionMetrics
-}
+	// Observe only detects and counts compressed requests and logs what
+	// would be decompressed, forwarding every request untouched. It is
+	// meant for measuring traffic before decompression is turned on.
+	Observe bool `json:"observe,omitempty"`
+
+	// InspectOnly decodes the body so the decompressed content can be
+	// inspected through placeholders, then forwards the original compressed
+	// body with Content-Encoding and Content-Length intact. Bodies that
+	// fail to decode are still rejected. It can't be combined with Stream
+	// or RecompressTo.
+	InspectOnly bool `json:"inspect_only,omitempty"`
+
+	// RetainOriginal keeps the compressed body, as the decoder read it, in
+	// the request context under OriginalBodyCtxKey, for later handlers that
+	// need both forms. It holds both in memory for the whole request and
+	// can't be combined with Stream.
+	RetainOriginal bool `json:"retain_original,omitempty"`
+
+	// SampleRate is the fraction of compressed requests, between 0 and 1,
+	// that are decoded, picked at random per request. The others are
+	// forwarded still compressed and left out of the metrics. Zero, the
+	// default, decodes every request.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// TeeTo is an http(s) URL or a file path that a copy of every
+	// decompressed body is sent to for auditing, from a background
+	// goroutine so requests never wait on it. Bodies are POSTed to a URL
+	// or appended to a file, each followed by a newline. Bodies that
+	// arrive while too many are waiting are dropped. It can't be combined
+	// with Stream.
+	TeeTo string `json:"tee_to,omitempty"`
+
+	// PeelOne decodes only the outermost, last applied, encoding of a
+	// chained Content-Encoding and forwards the body with the remaining
+	// encodings still applied and listed in Content-Encoding. Only the
+	// outermost encoding has to be supported. It can't be combined with
+	// RecompressTo.
+	PeelOne bool `json:"peel_one,omitempty"`
+
+	// LegacyBase64Order takes a base64 coding listed first in a chained
+	// Content-Encoding to have been applied last, as legacy clients that
+	// send "base64, gzip" for a gzip body that was then base64-encoded
+	// mean it. Without it such a list is decoded in the standard order of
+	// application and fails.
+	LegacyBase64Order bool `json:"legacy_base64_order,omitempty"`
+
+	// Stream decompresses the body lazily as the next handler reads it
+	// instead of buffering the whole decompressed body in memory first.
+	// The decompressed length is unknown up front, so the request is
+	// forwarded with chunked transfer encoding.
+	Stream bool `json:"stream,omitempty"`
+
+	// MaxDecompressedSize is the maximum number of bytes a request body may
+	// decompress to. Bodies that expand beyond it are rejected with 413
+	// Request Entity Too Large. A value of 0 means unlimited.
+	MaxDecompressedSize int64 `json:"max_size,omitempty"`
+
+	// TrustSizeHeader is the name of a request header whose value, a size
+	// such as "50MB", replaces MaxDecompressedSize for that request. It is
+	// meant to be set by an earlier handler, such as one that
+	// authenticates the client, and must not be settable by clients
+	// themselves. Missing or invalid values fall back to
+	// MaxDecompressedSize. If empty, no header is trusted.
+	TrustSizeHeader string `json:"trust_size_header,omitempty"`
+
+	// TrustDecodeQuery is the name of a query parameter, such as "_decode",
+	// whose value replaces the Content-Encoding header in deciding how the
+	// body is decoded. It is meant for debugging in trusted, internal
+	// environments only: anyone who can send requests can pick the
+	// decoder. If empty, no query parameter is trusted.
+	TrustDecodeQuery string `json:"trust_decode_query,omitempty"`
+
+	// MaxCompressedSize is the maximum size, in bytes, of a compressed
+	// request body. Requests whose Content-Length exceeds it are rejected
+	// with 413 Request Entity Too Large before any decoding happens; bodies
+	// of unknown length are rejected once they've been read past it. A
+	// value of 0 means unlimited.
+	MaxCompressedSize int64 `json:"max_compressed_size,omitempty"`
+
+	// MaxRatio is the largest ratio of decompressed to compressed bytes a
+	// body may reach while it is decoded. Bodies that exceed it are rejected
+	// with 400 Bad Request, which stops decompression bombs long before an
+	// absolute size limit would. The ratio is only enforced once the first
+	// megabyte has been decompressed. A value of 0 means unlimited.
+	MaxRatio float64 `json:"max_ratio,omitempty"`
+
+	// MinSize is the compressed body size, in bytes, below which requests
+	// are passed through untouched, Content-Encoding and all. Bodies of
+	// unknown length, as HTTP/2 and HTTP/3 requests often are, are read
+	// ahead to find out, as long as MinSize is at most 64KiB; above that,
+	// they are always decompressed.
+	MinSize int64 `json:"min_size,omitempty"`
+
+	// MaxEncodingLayers is the largest number of encodings a chained
+	// Content-Encoding may list, bounding how many decoders are stacked
+	// for one body. Requests with more are rejected with 400 Bad Request.
+	// A value of 0 means unlimited.
+	MaxEncodingLayers int `json:"max_encoding_layers,omitempty"`
+
+	// AllowedEncodings restricts which encodings are decompressed. Requests
+	// using any other encoding are rejected as unsupported. If empty, all
+	// built-in encodings are allowed.
+	AllowedEncodings []string `json:"encodings,omitempty"`
+
+	// EncodingToggles turns individual built-in encodings on or off.
+	// Encodings mapped to false are treated as unsupported; encodings not
+	// in the map stay enabled. It applies on top of AllowedEncodings.
+	EncodingToggles map[string]bool `json:"encoding_toggles,omitempty"`
+
+	// Sniff detects the encoding from the body's magic bytes when the
+	// request has no Content-Encoding header. Bodies that don't match a
+	// known format are passed through untouched.
+	Sniff bool `json:"sniff,omitempty"`
+
+	// MatchPath limits decompression to requests whose path matches one
+	// of these patterns, using the same syntax as Caddy's path matcher.
+	// Other requests are passed through untouched. If empty, requests on
+	// every path are decompressed.
+	MatchPath []string `json:"match_path,omitempty"`
+
+	// Methods limits decompression to requests using one of these
+	// methods. Other requests are passed through untouched, even when
+	// they carry a Content-Encoding. If empty, requests are decompressed
+	// regardless of method.
+	Methods []string `json:"methods,omitempty"`
+
+	// ContentTypes limits decompression to requests whose Content-Type,
+	// ignoring parameters such as charset, is one of these media types.
+	// Other requests are passed through untouched. If empty, requests are
+	// decompressed regardless of Content-Type.
+	ContentTypes []string `json:"content_types,omitempty"`
+
+	// SkipContentTypes lists media types that are never decompressed,
+	// compared like ContentTypes. Matching requests are passed through
+	// untouched, which is simpler than ContentTypes when only a few types
+	// are to be left alone.
+	SkipContentTypes []string `json:"skip_content_types,omitempty"`
+
+	// RequireHeader is the name of a request header that must be present
+	// for the request to be decompressed, so decompression can be rolled
+	// out to opted-in clients first. Requests without it are passed through
+	// untouched. If empty, no header is required.
+	RequireHeader string `json:"require_header,omitempty"`
+
+	// GRPCWeb decompresses gRPC-Web and gRPC requests that carry a
+	// grpc-encoding header. Their messages are compressed individually
+	// inside the length-prefixed framing rather than with Content-Encoding,
+	// so each compressed message is decoded, one at a time as the next
+	// handler reads the body, and the body rewritten with the messages
+	// uncompressed. Requests without grpc-encoding are handled as usual.
+	GRPCWeb bool `json:"grpc_web,omitempty"`
+
+	// Multipart decompresses the parts of multipart requests, such as
+	// multipart/form-data uploads, that carry a Content-Encoding header of
+	// their own. The body is rewritten with those parts decoded and their
+	// Content-Encoding header removed, as the next handler reads it. Only
+	// the plain parts in front of the first encoded one are read ahead, up
+	// to MaxCompressedSize or 4 MiB; bodies without an encoded part by then
+	// are forwarded untouched. Requests with a Content-Encoding of their
+	// own are handled as usual.
+	Multipart bool `json:"multipart,omitempty"`
+
+	// EncodingHeader is the request header the encodings are read from,
+	// for internal protocols that send them in a header of their own, such
+	// as X-Body-Encoding. It is removed once the body is decompressed, and
+	// carries the encodings left by PeelOne, PartialChain or RecompressTo.
+	// Defaults to Content-Encoding.
+	EncodingHeader string `json:"encoding_header,omitempty"`
+
+	// PreserveEncodingHeader is the name of a request header in which to
+	// keep the original encodings after Content-Encoding is removed from a
+	// decompressed request. If empty, the encodings are not kept.
+	PreserveEncodingHeader string `json:"preserve_encoding_header,omitempty"`
+
+	// SignalHeader is the name of a response header that is set to the
+	// original encodings of a decompressed request, so clients can tell
+	// that their body was decompressed. It is meant for debugging, as it
+	// reveals how requests are handled. If empty, no header is set.
+	SignalHeader string `json:"signal_header,omitempty"`
+
+	// OnUnsupported controls what happens to requests using an encoding
+	// that is unknown or not allowed: "reject" (the default) fails them
+	// with 400 Bad Request, and "passthrough" forwards them with their
+	// original body and Content-Encoding intact.
+	OnUnsupported string `json:"on_unsupported,omitempty"`
+
+	// PartialChain controls what happens to chained encodings whose outer
+	// layers are supported but an inner one isn't: "reject" (the default)
+	// handles the whole chain as unsupported, and "passthrough" decodes
+	// the supported outer layers and forwards the body with the remaining
+	// encodings listed in Content-Encoding. It can't be combined with
+	// RecompressTo.
+	PartialChain string `json:"partial_chain,omitempty"`
 
-// DecompressionMetrics tracks various metrics about decompression operations
-type DecompressionMetrics struct {
-	TotalRequests         int64
-	SuccessfulRequests    int64
-	FailedRequests        int64
-	DecompressionTimings  float64
-	RequestsByCompression map[string]*int64
+	// OnOversize controls what happens to bodies that decompress to more
+	// than MaxDecompressedSize: "reject" (the default) fails them with 413
+	// Request Entity Too Large, and "truncate" stops decoding at the limit
+	// and forwards the first MaxDecompressedSize bytes with an
+	// X-Decompress-Truncated: true request header. Truncating requires
+	// MaxDecompressedSize and can't be combined with Stream. gRPC bodies
+	// are always rejected, as truncating them would break the framing.
+	OnOversize string `json:"on_oversize,omitempty"`
+
+	// ForceChunked forwards buffered, decompressed bodies with chunked
+	// transfer encoding instead of a fixed Content-Length, for upstreams
+	// that stream-process request bodies. Stream mode always forwards
+	// bodies chunked.
+	ForceChunked bool `json:"force_chunked,omitempty"`
+
+	// RecompressTo re-encodes the decompressed body with this encoding
+	// before it is passed on, for upstreams that only understand one
+	// encoding. Content-Encoding and Content-Length are set to match.
+	// Bodies that already use only this encoding are forwarded untouched.
+	// It can't be combined with Stream.
+	RecompressTo string `json:"recompress_to,omitempty"`
+
+	// BufferSize is the size, in bytes, of the chunks the decoder is read
+	// in, whether the body is buffered or streamed. Larger buffers mean
+	// fewer, bigger reads on multi-megabyte bodies. Defaults to 32 KiB.
+	BufferSize int64 `json:"buffer_size,omitempty"`
+
+	// ErrorFormat controls how failed requests are answered: "caddy" (the
+	// default) returns the error to Caddy's error handling, and "json"
+	// responds directly with a JSON body describing the failure. Failures
+	// that surface while the next handler reads a streamed body are always
+	// left to that handler.
+	ErrorFormat string `json:"error_format,omitempty"`
+
+	// GzipErrors gzip-encodes the JSON error bodies of ErrorFormat "json"
+	// for clients whose Accept-Encoding accepts gzip, for tooling that
+	// expects compressed responses to compressed requests. It requires
+	// ErrorFormat "json".
+	GzipErrors bool `json:"gzip_errors,omitempty"`
+
+	// ErrorStatus is the status code for bodies that fail to decode or
+	// don't pass validate_utf8, validate_json or verify_uncompressed_length.
+	// It must be a 4xx or 5xx code. Limits, timeouts and unsupported
+	// encodings keep their own statuses. Defaults to 400 Bad Request.
+	ErrorStatus int `json:"error_status,omitempty"`
+
+	// ValidateUTF8 rejects decompressed bodies that aren't valid UTF-8
+	// with 400 Bad Request. It costs an extra pass over the body and can't
+	// be combined with Stream.
+	ValidateUTF8 bool `json:"validate_utf8,omitempty"`
+
+	// ValidateJSON rejects decompressed bodies that don't parse as JSON
+	// with 400 Bad Request. Like ValidateUTF8, it can't be combined with
+	// Stream.
+	ValidateJSON bool `json:"validate_json,omitempty"`
+
+	// JSONPrefix stops decoding once the decompressed body holds a
+	// complete top-level JSON value, and forwards just that value, for
+	// ingestion endpoints that only need the first one of a large body.
+	// The rest of the body is dropped on purpose, unread. It doesn't
+	// apply to Multipart or GRPCWeb bodies.
+	JSONPrefix bool `json:"json_prefix,omitempty"`
+
+	// VerifyUncompressedLength is the name of a request header in which
+	// clients declare the decompressed size of the body. Bodies that
+	// decompress to any other size, or come with an unparsable value, are
+	// rejected with 400 Bad Request; requests without the header aren't
+	// checked. It can't be combined with Stream.
+	VerifyUncompressedLength string `json:"verify_uncompressed_length,omitempty"`
+
+	// MaxConcurrent limits how many request bodies are decompressed at
+	// once. A value of 0 means unlimited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// ConcurrencyTimeout is how long a request waits for a decompression
+	// slot when MaxConcurrent are already in use before it is rejected with
+	// 503 Service Unavailable. If zero, it is rejected right away.
+	ConcurrencyTimeout caddy.Duration `json:"concurrency_timeout,omitempty"`
+
+	// DecompressTimeout is the longest a single body may take to decode,
+	// from the first read of the compressed body to the last byte of
+	// output. Bodies that take longer are rejected with 504 Gateway
+	// Timeout. In Stream mode it includes the time the next handler takes
+	// to read the body. A value of 0 means no limit.
+	DecompressTimeout caddy.Duration `json:"decompress_timeout,omitempty"`
+
+	// RateLimitPerIP limits how many request bodies each client IP may
+	// have decompressed per second, with bursts of up to that many.
+	// Requests over the limit are rejected with 429 Too Many Requests.
+	// The client IP honors X-Forwarded-For only from TrustedProxies, or
+	// without them from the server's trusted proxies. A value of 0 means
+	// unlimited.
+	RateLimitPerIP float64 `json:"rate_limit_per_ip,omitempty"`
+
+	// TrustedProxies lists the CIDR ranges, or single addresses, of the
+	// proxies whose X-Forwarded-For and X-Real-IP headers are believed
+	// when telling client IPs apart, for RateLimitPerIP. If empty, the
+	// client IP Caddy determined is used, which honors the server's own
+	// trusted_proxies.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// CacheIdempotentSize, if set, keeps the decompressed bodies of
+	// requests that carry an Idempotency-Key header, so a retry sending the
+	// same key and the same compressed body isn't decoded again. It is the
+	// most bytes of decompressed bodies kept at once; the least recently
+	// used are dropped first, and bodies larger than that are never kept.
+	// Requests with the header have their compressed body read ahead to
+	// hash it, up to this size or MaxDecompressedSize, whichever is
+	// smaller; larger bodies are decoded as usual and not cached. It can't
+	// be combined with Stream. A value of 0 disables the cache.
+	CacheIdempotentSize int64 `json:"cache_idempotent_size,omitempty"`
+
+	// CacheIdempotentTTL is how long a body stays in the cache of
+	// CacheIdempotentSize. Defaults to 1 minute.
+	CacheIdempotentTTL caddy.Duration `json:"cache_idempotent_ttl,omitempty"`
+
+	// GzipMultistream controls whether a gzip body may consist of several
+	// concatenated members, which are decoded as one stream. When false,
+	// only the first member is decoded and anything after it is ignored,
+	// for clients that pad the body after the gzip data. Defaults to true.
+	GzipMultistream *bool `json:"gzip_multistream,omitempty"`
+
+	// ZstdDict is the path to a zstd dictionary to decode zstd bodies
+	// with, for clients that compress with a shared dictionary. Bodies
+	// compressed without a dictionary still decode.
+	ZstdDict string `json:"zstd_dict,omitempty"`
+
+	// ZstdConcurrency is how many goroutines each zstd decoder may use.
+	// More goroutines decode large bodies faster but take more memory.
+	// Values above 1 can't be combined with Stream. Defaults to 1.
+	ZstdConcurrency int `json:"zstd_concurrency,omitempty"`
+
+	// DeflateDict is the path to a preset dictionary to decode deflate
+	// bodies with. zlib bodies that declare a dictionary are rejected if
+	// its checksum doesn't match this one; bodies compressed without a
+	// dictionary still decode.
+	DeflateDict string `json:"deflate_dict,omitempty"`
+
+	// CompressResponse turns on compression of response bodies, with the
+	// encoding from this list, in order of preference, that the client's
+	// Accept-Encoding ranks highest. Responses that are already encoded,
+	// partial, or shorter than 512 bytes are sent as they are. It works
+	// independently of request decompression and applies to every request
+	// the handler sees. If empty, responses are never compressed.
+	CompressResponse []string `json:"compress_response,omitempty"`
+
+	// Debug sends the decompression ratio and the time spent decoding as
+	// the X-Decompress-Ratio and X-Decompress-Duration-Ms response
+	// trailers of requests that were decompressed. Trailers are only
+	// delivered over HTTP/2 and chunked HTTP/1.1 responses.
+	Debug bool `json:"debug,omitempty"`
+
+	// OnSuccess, if set, is called after a request body is decoded, with
+	// its encoding as in Content-Encoding and its compressed and
+	// decompressed sizes. Hooks can only be set from Go, for example when
+	// using WithNext or embedding the module in another plugin.
+	OnSuccess func(encoding string, in, out int64) `json:"-"`
+
+	// OnError, if set, is called when a request is rejected because its
+	// body could not be decoded. Requests abandoned by the client are not
+	// reported. Hooks run on the request's goroutine and must be safe for
+	// concurrent use.
+	OnError func(encoding string, err error) `json:"-"`
+
+	// DecoderFactory, if set, is asked for the decoder of every encoding
+	// before the built-in decoders are, so tests can stub decoders and
+	// programs can add formats this module doesn't know. Returning an
+	// error wrapping ErrUnsupportedEncoding, without reading from r, falls
+	// back to the built-in decoder. Encodings that aren't built in are only
+	// decoded when they are listed in AllowedEncodings.
+	DecoderFactory func(encoding string, r io.Reader) (io.ReadCloser, error) `json:"-"`
+
+	logger         *zap.Logger
+	metrics        *DecompressionMetrics
+	pathMatcher    caddyhttp.MatchPath
+	slots          chan struct{}
+	limiters       *ipLimiters
+	trustedProxies []netip.Prefix
+	tee            *teeSink
+	cache          *decodeCache
+	decoders       map[string]decodeFunc
+	zstdDictID     uint32
+	readers        *sync.Pool
+	provisioned    bool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -49,87 +427,1561 @@ func (Middleware) CaddyModule() caddy.ModuleInfo {
 // Provision implements caddy.Provisioner.
 func (m *Middleware) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger()
-	m.metrics = &DecompressionMetrics{
-		RequestsByCompression: make(map[string]*int64),
+
+	metrics, err := newDecompressionMetrics(ctx.GetMetricsRegistry())
+	if err != nil {
+		return fmt.Errorf("registering metrics: %v", err)
+	}
+	m.metrics = metrics
+
+	if len(m.MatchPath) > 0 {
+		m.pathMatcher = slices.Clone(m.MatchPath)
+		if err := m.pathMatcher.Provision(ctx); err != nil {
+			return fmt.Errorf("provisioning path matcher: %v", err)
+		}
+	}
+
+	if m.MaxConcurrent > 0 {
+		m.slots = make(chan struct{}, m.MaxConcurrent)
+	}
+	if m.RateLimitPerIP > 0 {
+		m.limiters = newIPLimiters(m.RateLimitPerIP)
+	}
+	if m.trustedProxies, err = parseTrustedProxies(m.TrustedProxies); err != nil {
+		return err
+	}
+
+	bufferSize := int(m.BufferSize)
+	if bufferSize == 0 {
+		bufferSize = defaultBufferSize
+	}
+	m.readers = &sync.Pool{New: func() any {
+		return bufio.NewReaderSize(nil, bufferSize)
+	}}
+
+	if m.ZstdDict != "" && decoderFactories["zstd"] == nil {
+		return errors.New("zstd_dict is set, but this build leaves out zstd")
+	}
+	if m.ZstdConcurrency != 0 && decoderFactories["zstd"] == nil {
+		return errors.New("zstd_concurrency is set, but this build leaves out zstd")
+	}
+	if m.DeflateDict != "" && decoderFactories["deflate"] == nil {
+		return errors.New("deflate_dict is set, but this build leaves out deflate")
+	}
+	if m.LegacyBase64Order && decoderFactories["base64"] == nil {
+		return errors.New("legacy_base64_order is set, but this build leaves out base64")
+	}
+	m.decoders = make(map[string]decodeFunc, len(decoderFactories))
+	for encoding, factory := range decoderFactories {
+		decode, err := factory(m)
+		if err != nil {
+			return err
+		}
+		m.decoders[encoding] = decode
+	}
+
+	if m.CacheIdempotentSize > 0 {
+		ttl := time.Duration(m.CacheIdempotentTTL)
+		if ttl == 0 {
+			ttl = defaultCacheTTL
+		}
+		m.cache = newDecodeCache(m.CacheIdempotentSize, ttl)
+	}
+
+	if m.TeeTo != "" {
+		if m.tee, err = newTeeSink(m.TeeTo, m.logger); err != nil {
+			return err
+		}
+	}
+
+	if m.TrustDecodeQuery != "" {
+		m.logger.Warn("trust_decode_query is enabled, clients can choose how request bodies are decoded",
+			zap.String("parameter", m.TrustDecodeQuery))
+	}
+
+	liveMetrics.Store(m.metrics, struct{}{})
+	m.provisioned = true
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (m *Middleware) Cleanup() error {
+	if m.metrics != nil {
+		liveMetrics.Delete(m.metrics)
+	}
+	if m.tee != nil {
+		m.tee.close()
 	}
 	return nil
 }
 
 // Validate implements caddy.Validator.
 func (m *Middleware) Validate() error {
+	if m.MaxDecompressedSize < 0 {
+		return fmt.Errorf("max_size must not be negative, got %d", m.MaxDecompressedSize)
+	}
+	if m.MaxCompressedSize < 0 {
+		return fmt.Errorf("max_compressed_size must not be negative, got %d", m.MaxCompressedSize)
+	}
+	if m.MinSize < 0 {
+		return fmt.Errorf("min_size must not be negative, got %d", m.MinSize)
+	}
+	if m.MaxDecompressedSize > 0 && m.MinSize > m.MaxDecompressedSize {
+		return fmt.Errorf("min_size (%d) is greater than max_size (%d)", m.MinSize, m.MaxDecompressedSize)
+	}
+	if m.MaxCompressedSize > 0 && m.MinSize > m.MaxCompressedSize {
+		return fmt.Errorf("min_size (%d) is greater than max_compressed_size (%d)", m.MinSize, m.MaxCompressedSize)
+	}
+	if m.BufferSize < 0 {
+		return fmt.Errorf("buffer_size must be positive, got %d", m.BufferSize)
+	}
+	if m.SampleRate < 0 || m.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1, got %g", m.SampleRate)
+	}
+	if m.MaxRatio < 0 {
+		return fmt.Errorf("max_ratio must not be negative, got %g", m.MaxRatio)
+	}
+	if m.ErrorStatus != 0 && (m.ErrorStatus < 400 || m.ErrorStatus > 599) {
+		return fmt.Errorf("error_status must be a 4xx or 5xx status code, got %d", m.ErrorStatus)
+	}
+	if m.MaxEncodingLayers < 0 {
+		return fmt.Errorf("max_encoding_layers must not be negative, got %d", m.MaxEncodingLayers)
+	}
+	if m.ZstdConcurrency < 0 {
+		return fmt.Errorf("zstd_concurrency must be at least 1, got %d", m.ZstdConcurrency)
+	}
+	if m.ZstdConcurrency > 1 && m.Stream {
+		return errors.New("zstd_concurrency above 1 can't be combined with stream")
+	}
+	if m.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent must not be negative, got %d", m.MaxConcurrent)
+	}
+	if m.ConcurrencyTimeout < 0 {
+		return fmt.Errorf("concurrency_timeout must not be negative, got %s", time.Duration(m.ConcurrencyTimeout))
+	}
+	if m.ConcurrencyTimeout > 0 && m.MaxConcurrent == 0 {
+		return errors.New("concurrency_timeout requires max_concurrent")
+	}
+	if m.DecompressTimeout < 0 {
+		return fmt.Errorf("decompress_timeout must not be negative, got %s", time.Duration(m.DecompressTimeout))
+	}
+	if m.RateLimitPerIP < 0 {
+		return fmt.Errorf("rate_limit_per_ip must not be negative, got %g", m.RateLimitPerIP)
+	}
+	if m.CacheIdempotentSize < 0 {
+		return fmt.Errorf("cache_idempotent size must not be negative, got %d", m.CacheIdempotentSize)
+	}
+	if m.CacheIdempotentTTL < 0 {
+		return fmt.Errorf("cache_idempotent TTL must not be negative, got %s", time.Duration(m.CacheIdempotentTTL))
+	}
+	if m.CacheIdempotentTTL > 0 && m.CacheIdempotentSize == 0 {
+		return errors.New("cache_idempotent TTL requires a cache size")
+	}
+
+	// A nil list allows every encoding, but an explicitly empty one would
+	// allow none, which is never what was meant.
+	if m.AllowedEncodings != nil && len(m.AllowedEncodings) == 0 {
+		return errors.New("encodings must list at least one encoding")
+	}
+	for _, encoding := range m.AllowedEncodings {
+		if !slices.Contains(builtinEncodings, encoding) && m.DecoderFactory == nil {
+			return fmt.Errorf("unsupported encoding '%s' in encodings; supported: %s",
+				encoding, strings.Join(builtinEncodings, ", "))
+		}
+	}
+
+	for encoding := range m.EncodingToggles {
+		if !slices.Contains(builtinEncodings, encoding) {
+			return fmt.Errorf("unsupported encoding '%s' in encoding_toggles; supported: %s",
+				encoding, strings.Join(builtinEncodings, ", "))
+		}
+	}
+
+	if m.InspectOnly && m.Stream {
+		return errors.New("inspect_only can't be combined with stream")
+	}
+	if m.InspectOnly && m.RecompressTo != "" {
+		return errors.New("inspect_only can't be combined with recompress_to")
+	}
+	if m.Stream && m.RetainOriginal {
+		return errors.New("retain_original can't be combined with stream")
+	}
+	if m.Stream && m.TeeTo != "" {
+		return errors.New("tee_to can't be combined with stream")
+	}
+	if m.Stream && m.CacheIdempotentSize > 0 {
+		return errors.New("cache_idempotent can't be combined with stream")
+	}
+	if m.Stream && m.VerifyUncompressedLength != "" {
+		return errors.New("verify_uncompressed_length can't be combined with stream")
+	}
+	if m.Stream && (m.ValidateUTF8 || m.ValidateJSON) {
+		return errors.New("validate_utf8 and validate_json can't be combined with stream")
+	}
+	for _, encoding := range m.CompressResponse {
+		if !slices.Contains(responseEncodings(), encoding) {
+			return fmt.Errorf("unsupported compress_response encoding '%s'; supported: %s",
+				encoding, strings.Join(responseEncodings(), ", "))
+		}
+	}
+	if m.EncodingHeader != "" && strings.EqualFold(m.EncodingHeader, m.PreserveEncodingHeader) {
+		return errors.New("encoding_header and preserve_encoding_header must name different headers")
+	}
+	if m.GzipErrors && m.ErrorFormat != errorFormatJSON {
+		return errors.New("gzip_errors requires error_format json")
+	}
+	if m.PeelOne && m.RecompressTo != "" {
+		return errors.New("peel_one can't be combined with recompress_to")
+	}
+
+	if m.RecompressTo != "" {
+		if !slices.Contains(recompressEncodings, m.RecompressTo) {
+			return fmt.Errorf("unsupported recompress_to encoding '%s'; supported: %s",
+				m.RecompressTo, strings.Join(recompressEncodings, ", "))
+		}
+		if m.Stream {
+			return errors.New("recompress_to can't be combined with stream")
+		}
+	}
+
+	switch m.OnUnsupported {
+	case "", unsupportedReject, unsupportedPassthrough:
+	default:
+		return fmt.Errorf("unrecognized on_unsupported value '%s'", m.OnUnsupported)
+	}
+
+	switch m.PartialChain {
+	case "", partialChainReject:
+	case partialChainPassthrough:
+		if m.RecompressTo != "" {
+			return errors.New("partial_chain passthrough can't be combined with recompress_to")
+		}
+	default:
+		return fmt.Errorf("unrecognized partial_chain value '%s'", m.PartialChain)
+	}
+
+	switch m.OnOversize {
+	case "", oversizeReject:
+	case oversizeTruncate:
+		if m.MaxDecompressedSize == 0 && m.TrustSizeHeader == "" {
+			return errors.New("on_oversize truncate requires max_size or trust_size_header")
+		}
+		if m.Stream {
+			return errors.New("on_oversize truncate can't be combined with stream")
+		}
+	default:
+		return fmt.Errorf("unrecognized on_oversize value '%s'", m.OnOversize)
+	}
+
+	switch m.ErrorFormat {
+	case "", errorFormatCaddy, errorFormatJSON:
+	default:
+		return fmt.Errorf("unrecognized error_format value '%s'", m.ErrorFormat)
+	}
 	return nil
 }
 
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	if r.Header.Get("Content-Encoding") == "" {
+	// Whatever body an upgrade request carries belongs to the handshake,
+	// which is left to the upstream exactly as the client sent it.
+	if isUpgrade(r) {
+		return next.ServeHTTP(w, r)
+	}
+
+	if len(m.CompressResponse) > 0 {
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			method:         r.Method,
+			encoding:       negotiateEncoding(r.Header.Get("Accept-Encoding"), m.CompressResponse),
+		}
+		defer cw.Close()
+		w = cw
+	}
+
+	if m.pathMatcher != nil {
+		match, err := m.pathMatcher.MatchWithError(r)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		if !match {
+			return next.ServeHTTP(w, r)
+		}
+	}
+
+	if len(m.Methods) > 0 && !slices.Contains(m.Methods, r.Method) {
 		return next.ServeHTTP(w, r)
 	}
 
-	atomic.AddInt64(&m.metrics.TotalRequests, 1)
+	if len(m.ContentTypes) > 0 && !matchesContentType(r, m.ContentTypes) {
+		return next.ServeHTTP(w, r)
+	}
 
-	encoding := strings.ToLower(r.Header.Get("Content-Encoding"))
-	if _, exists := m.metrics.RequestsByCompression[encoding]; !exists {
-		m.metrics.RequestsByCompression[encoding] = new(int64)
+	if len(m.SkipContentTypes) > 0 && matchesContentType(r, m.SkipContentTypes) {
+		return next.ServeHTTP(w, r)
 	}
-	atomic.AddInt64(m.metrics.RequestsByCompression[encoding], 1)
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		atomic.AddInt64(&m.metrics.FailedRequests, 1)
-		return caddyhttp.Error(http.StatusBadRequest, err)
+	if m.RequireHeader != "" && len(r.Header.Values(m.RequireHeader)) == 0 {
+		return next.ServeHTTP(w, r)
 	}
 
-	var decompressed []byte
-	switch encoding {
-	case "gzip":
-		reader, err := gzip.NewReader(bytes.NewReader(body))
-		if err != nil {
-			atomic.AddInt64(&m.metrics.FailedRequests, 1)
-			return caddyhttp.Error(http.StatusBadRequest, err)
+	if m.MinSize > 0 && r.ContentLength >= 0 && r.ContentLength < m.MinSize {
+		return next.ServeHTTP(w, r)
+	}
+
+	if m.GRPCWeb {
+		if encoding, ok := parseEncoding(r.Header.Get("Grpc-Encoding")); ok && encoding != "identity" {
+			return m.serveGRPC(w, r, next, encoding)
 		}
-		decompressed, err = io.ReadAll(reader)
-		reader.Close()
+	}
 
-	case "bz2":
-		reader := bzip2.NewReader(bytes.NewReader(body))
-		decompressed, err = io.ReadAll(reader)
+	if m.Multipart && len(r.Header.Values(m.encodingHeader())) == 0 {
+		if boundary := multipartBoundary(r); boundary != "" {
+			return m.serveMultipart(w, r, next, boundary)
+		}
+	}
 
-	case "zstd":
-		decoder, err := zstd.NewReader(bytes.NewReader(body))
+	var encodings []string
+	if m.TrustDecodeQuery != "" {
+		encodings = parseContentEncoding(r.URL.Query().Get(m.TrustDecodeQuery))
+	}
+	if len(encodings) > 0 {
+		m.logger.Debug("decoding as the query parameter says",
+			zap.String("parameter", m.TrustDecodeQuery),
+			zap.String("encoding", strings.Join(encodings, ", ")),
+		)
+	} else if header := strings.Join(r.Header.Values(m.encodingHeader()), ","); header != "" {
+		// A coding list may be split over several header lines, which
+		// together form a single list in order (RFC 9110, section 5.3).
+		encodings = parseContentEncoding(header)
+	} else {
+		var encoding string
+		if m.Sniff {
+			encoding = sniffEncoding(r)
+		}
+		if encoding == "" {
+			m.metrics.requestUncompressed()
+			m.logger.Debug("request has no Content-Encoding, passing through")
+			return next.ServeHTTP(w, r)
+		}
+		atomic.AddInt64(&m.metrics.SniffedRequests, 1)
+		m.logger.Debug("sniffed request body encoding", zap.String("encoding", encoding))
+		encodings = []string{encoding}
+	}
+	if m.LegacyBase64Order {
+		encodings = legacyBase64Order(encodings)
+	}
+
+	// The inner encodings are left for the upstream, so from here on only
+	// the outermost one is considered.
+	var remaining []string
+	if m.PeelOne && len(encodings) > 1 {
+		remaining = encodings[:len(encodings)-1]
+		encodings = encodings[len(encodings)-1:]
+	}
+	// Likewise, the outer layers that can be decoded are, and everything
+	// from the innermost unsupported one on is left.
+	if m.PartialChain == partialChainPassthrough && len(encodings) > 1 {
+		i := len(encodings)
+		for i > 0 && m.canDecode(encodings[i-1]) {
+			i--
+		}
+		if i > 0 && i < len(encodings) {
+			remaining = encodings[:i]
+			encodings = encodings[i:]
+		}
+	}
+
+	if m.SampleRate > 0 && rand.Float64() >= m.SampleRate {
+		return next.ServeHTTP(w, r)
+	}
+
+	// Without a Content-Length, which HTTP/2 and HTTP/3 clients often
+	// leave out, and chunked HTTP/1.1 requests lack, the body is read
+	// ahead instead. That is only done for compressed bodies.
+	if m.MinSize > 0 && r.ContentLength < 0 && bodyShorterThan(r, m.MinSize) {
+		return next.ServeHTTP(w, r)
+	}
+
+	m.metrics.requestStarted(encodings)
+
+	if m.Observe {
+		m.logger.Info("would decompress request body",
+			zap.String("encoding", strings.Join(encodings, ", ")),
+			zap.Int64("compressed_size", r.ContentLength),
+			zap.Bool("supported", !slices.ContainsFunc(encodings, func(encoding string) bool {
+				return !m.canDecode(encoding)
+			})),
+		)
+		m.metrics.requestPassedThrough(encodings)
+		return next.ServeHTTP(w, r)
+	}
+
+	if m.MaxEncodingLayers > 0 && len(encodings) > m.MaxEncodingLayers {
+		err := withReason(reasonTooManyLayers,
+			fmt.Errorf("body has %d encoding layers, more than the %d allowed", len(encodings), m.MaxEncodingLayers))
+		return m.fail(w, r, encodings, http.StatusBadRequest, err)
+	}
+
+	for _, encoding := range encodings {
+		if !m.canDecode(encoding) {
+			if m.OnUnsupported == unsupportedPassthrough {
+				m.metrics.requestPassedThrough(encodings)
+				return next.ServeHTTP(w, r)
+			}
+			return m.fail(w, r, encodings, http.StatusBadRequest, unsupportedEncodingError(encoding))
+		}
+	}
+
+	// A body already in the target encoding is forwarded as it is.
+	if m.RecompressTo != "" && len(encodings) == 1 && encodings[0] == m.RecompressTo {
+		m.metrics.requestPassedThrough(encodings)
+		return next.ServeHTTP(w, r)
+	}
+
+	// An empty body has nothing to decode, and most decoders reject it as
+	// truncated, so it is forwarded as an empty decompressed body.
+	if isEmptyBody(r) {
+		if err := m.verifyLength(r, 0); err != nil {
+			return m.fail(w, r, encodings, m.errorStatus(), withReason(reasonLengthMismatch, err))
+		}
+		m.decodeSucceeded(encodings, 0, 0, 0)
+		setPlaceholders(r, encodings, 0)
+		setVars(r, encodings)
+		m.setSignalHeader(w, encodings)
+		if m.InspectOnly {
+			setBodyPlaceholder(r, nil)
+			return next.ServeHTTP(w, r)
+		}
+		m.removeEncoding(r, encodings, remaining)
+		r.ContentLength = 0
+		return next.ServeHTTP(w, r)
+	}
+
+	if m.MaxCompressedSize > 0 && r.ContentLength > m.MaxCompressedSize {
+		err := withReason(reasonCompressedSize, fmt.Errorf("compressed body exceeds %d bytes", m.MaxCompressedSize))
+		return m.fail(w, r, encodings, http.StatusRequestEntityTooLarge, err)
+	}
+
+	if m.limiters != nil && !m.limiters.allow(m.clientIP(r)) {
+		err := withReason(reasonRateLimited, errors.New("too many decompressions from this client"))
+		return m.fail(w, r, encodings, http.StatusTooManyRequests, err)
+	}
+
+	// In streaming mode the body is decoded while the next handler reads
+	// it, so the slot is held until that handler returns.
+	releaseSlot := func() {}
+	if m.slots != nil {
+		if !m.acquireSlot(r) {
+			err := withReason(reasonBusy, errors.New("too many concurrent decompressions"))
+			return m.fail(w, r, encodings, http.StatusServiceUnavailable, err)
+		}
+		releaseSlot = sync.OnceFunc(func() { <-m.slots })
+		defer releaseSlot()
+	}
+
+	start := time.Now()
+	span := startDecodeSpan(r.Context(), encodings)
+	ctx, cancel := m.decodeContext(w, r)
+	defer cancel()
+	// In inspect-only mode the compressed bytes the decoder consumes are
+	// kept, so the original body can be put back together afterwards.
+	var src io.Reader = r.Body
+	var raw bytes.Buffer
+	if m.InspectOnly || m.RetainOriginal {
+		src = io.TeeReader(r.Body, &raw)
+	}
+	if m.DecompressTimeout > 0 {
+		// Decoders can consume a lot of input without producing any
+		// output, so a slow client is also checked on the way in.
+		src = &contextReader{ReadCloser: io.NopCloser(src), ctx: ctx}
+	}
+	compressed := &countingReader{Reader: src}
+	if m.MaxCompressedSize > 0 && r.ContentLength < 0 {
+		compressed.Reader = &compressedLimitedReader{Reader: src, limit: m.MaxCompressedSize}
+	}
+
+	// A retry of a body that was decompressed before is answered from the
+	// cache, which needs the whole compressed body to tell it apart. Only
+	// bodies that could be cached are read ahead, and at most as much as
+	// could be, so the read is bounded whether the key is sent or not.
+	maxSize := m.maxSize(r)
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	cacheLimit := m.CacheIdempotentSize
+	if maxSize > 0 && maxSize < cacheLimit {
+		cacheLimit = maxSize
+	}
+	useCache := m.cache != nil && idempotencyKey != "" && r.ContentLength <= cacheLimit
+	var key cacheKey
+	var cached []byte
+	var hit bool
+	if useCache {
+		rest := compressed.Reader
+		body, err := io.ReadAll(io.LimitReader(compressed, cacheLimit+1))
 		if err != nil {
-			atomic.AddInt64(&m.metrics.FailedRequests, 1)
-			return caddyhttp.Error(http.StatusBadRequest, err)
+			endDecodeSpan(span, compressed.n, 0, err)
+			if clientAborted(ctx, r, compressed) {
+				m.decodeAborted(encodings, err)
+				return caddyhttp.Error(statusClientClosedRequest, err)
+			}
+			return m.fail(w, r, encodings, m.decodeErrorStatus(err), err)
 		}
-		decompressed, err = io.ReadAll(decoder)
-		decoder.Close()
+		if int64(len(body)) > cacheLimit {
+			// Too large to cache, so it is decoded as usual, with the
+			// bytes read so far put back in front of the rest.
+			useCache = false
+			compressed.Reader, compressed.n = io.MultiReader(bytes.NewReader(body), rest), 0
+		} else {
+			key = newCacheKey(idempotencyKey, encodings, body)
+			if cached, hit = m.cache.get(key); !hit {
+				compressed.Reader, compressed.n = bytes.NewReader(body), 0
+			}
+		}
+	}
 
-	default:
-		atomic.AddInt64(&m.metrics.FailedRequests, 1)
-		return caddyhttp.Error(http.StatusBadRequest, 
-			fmt.Errorf("unsupported Content-Encoding: %s", encoding))
+	limits := decodeLimits{
+		maxSize:    maxSize,
+		truncate:   m.OnOversize == oversizeTruncate,
+		maxRatio:   m.MaxRatio,
+		jsonPrefix: m.JSONPrefix,
+	}
+	var decoded *bodyDecoder
+	var err error
+	if hit {
+		atomic.AddInt64(&m.metrics.CachedRequests, 1)
+		m.logger.Debug("serving decompressed body from cache",
+			zap.String("idempotency_key", idempotencyKey))
+		// Already decoded, but still held to the limits.
+		decoded, err = m.newBodyDecoder(nil, bytes.NewReader(cached), compressed, limits)
+	} else {
+		decoded, err = m.newBodyDecoder(encodings, compressed, compressed, limits)
 	}
+	if err != nil {
+		// Building a decoder may read the start of the body, which fails
+		// like any other read when the client goes away.
+		endDecodeSpan(span, compressed.n, 0, err)
+		if clientAborted(ctx, r, compressed) {
+			m.decodeAborted(encodings, err)
+			return caddyhttp.Error(statusClientClosedRequest, err)
+		}
+		// Nor is a failure to read the body, which says nothing about the
+		// header, blamed on it.
+		if compressed.err == nil {
+			err = headerError(err)
+		}
+		return m.fail(w, r, encodings, m.decodeErrorStatus(err), err)
+	}
+	prefix, limited := decoded.prefix, decoded.limited
+
+	var decoder io.ReadCloser = &contextReader{ReadCloser: decoded, ctx: ctx}
+	decoder = newBufferedDecoder(decoder, m.readers)
 
+	var stats decodeStats
+	if m.Stream {
+		r.Body = &decompressReader{
+			ReadCloser: decoder,
+			body:       r.Body,
+			stop:       cancel,
+			onDone: func(decompressedSize int64, err error) {
+				endDecodeSpan(span, compressed.n, decompressedSize, err)
+				if err != nil && clientAborted(ctx, r, compressed) {
+					m.decodeAborted(encodings, err)
+					return
+				}
+				if err != nil {
+					m.decodeFailed(encodings, streamError(err))
+					return
+				}
+				elapsed := time.Since(start)
+				m.decodeSucceeded(encodings, compressed.n, decompressedSize, elapsed)
+				stats.set(compressed.n, decompressedSize, elapsed)
+				setPlaceholders(r, encodings, decompressedSize)
+			},
+		}
+		m.removeEncoding(r, encodings, remaining)
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+		// Unlike the placeholders, the vars can't wait for the body to be
+		// read, or the next handler's matchers wouldn't see them.
+		setVars(r, encodings)
+		m.setSignalHeader(w, encodings)
+		// Ends the span if the body is never read to the end.
+		defer span.End()
+		return m.serveDecoded(w, r, next, &stats)
+	}
+
+	// A truncated stream must fail the request rather than forward a
+	// partial body, so errors from both the read and the close count.
+	decompressed, err := io.ReadAll(decoder)
+	if closeErr := decoder.Close(); err == nil {
+		err = closeErr
+	}
+	aborted := err != nil && clientAborted(ctx, r, compressed)
+	// The timeout only covers decoding; left armed, it would cut off the
+	// next handler's own reads of the connection.
+	cancel()
+	releaseSlot()
+	endDecodeSpan(span, compressed.n, int64(len(decompressed)), err)
+	if aborted {
+		m.decodeAborted(encodings, err)
+		return caddyhttp.Error(statusClientClosedRequest, err)
+	}
 	if err != nil {
-		atomic.AddInt64(&m.metrics.FailedRequests, 1)
-		return caddyhttp.Error(http.StatusBadRequest, err)
+		return m.fail(w, r, encodings, m.decodeErrorStatus(err), streamError(err))
+	}
+	if err := m.validateBody(decompressed); err != nil {
+		return m.fail(w, r, encodings, m.errorStatus(), withReason(reasonInvalidBody, err))
+	}
+	// A truncated body is short on purpose, as is one cut after its first
+	// JSON value.
+	if (limited == nil || !limited.truncated) && (prefix == nil || !prefix.cut) {
+		if err := m.verifyLength(r, int64(len(decompressed))); err != nil {
+			return m.fail(w, r, encodings, m.errorStatus(), withReason(reasonLengthMismatch, err))
+		}
+		if useCache && !hit {
+			m.cache.put(key, decompressed)
+		}
 	}
 
-	atomic.AddInt64(&m.metrics.SuccessfulRequests, 1)
-	r.Body = io.NopCloser(bytes.NewReader(decompressed))
-	r.Header.Del("Content-Encoding")
-	r.ContentLength = int64(len(decompressed))
+	elapsed := time.Since(start)
+	m.decodeSucceeded(encodings, compressed.n, int64(len(decompressed)), elapsed)
+	stats.set(compressed.n, int64(len(decompressed)), elapsed)
+	setPlaceholders(r, encodings, int64(len(decompressed)))
+	setVars(r, encodings)
+	m.setSignalHeader(w, encodings)
+	if m.tee != nil {
+		// Nothing below modifies decompressed, so it is shared as it is.
+		m.tee.send(r.Header.Get("Content-Type"), decompressed)
+	}
+	if limited != nil && limited.truncated {
+		m.logger.Info("truncated decompressed request body",
+			zap.String("encoding", strings.Join(encodings, ", ")),
+			zap.Int64("max_size", maxSize),
+		)
+		r.Header.Set(truncatedHeader, "true")
+	}
+	if m.RetainOriginal {
+		r = r.WithContext(context.WithValue(r.Context(), OriginalBodyCtxKey, raw.Bytes()))
+	}
 
-	return next.ServeHTTP(w, r)
+	if m.InspectOnly {
+		// Decoders may stop short of the end of the body, so whatever
+		// they didn't consume follows the bytes they did.
+		setBodyPlaceholder(r, decompressed)
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&raw, r.Body), r.Body}
+		return m.serveDecoded(w, r, next, &stats)
+	}
+
+	m.removeEncoding(r, encodings, remaining)
+
+	body := decompressed
+	if m.RecompressTo != "" {
+		body, err = recompress(m.RecompressTo, decompressed)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("recompressing to %s: %v", m.RecompressTo, err))
+		}
+		r.Header.Set(m.encodingHeader(), m.RecompressTo)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	m.setLength(r, int64(len(body)))
+
+	return m.serveDecoded(w, r, next, &stats)
+}
+
+// setLength sets the length a buffered body is forwarded with, unless
+// ForceChunked is set, in which case it is sent chunked.
+func (m *Middleware) setLength(r *http.Request, length int64) {
+	if m.ForceChunked {
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		r.TransferEncoding = []string{"chunked"}
+		return
+	}
+	r.ContentLength = length
+}
+
+// maxSize returns the decompressed size limit for r: the size in its
+// TrustSizeHeader header if there is a valid one, or MaxDecompressedSize.
+func (m *Middleware) maxSize(r *http.Request) int64 {
+	if m.TrustSizeHeader == "" {
+		return m.MaxDecompressedSize
+	}
+	value := r.Header.Get(m.TrustSizeHeader)
+	if value == "" {
+		return m.MaxDecompressedSize
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil || size > math.MaxInt64 {
+		m.logger.Debug("ignoring invalid size header",
+			zap.String("header", m.TrustSizeHeader),
+			zap.String("value", value),
+		)
+		return m.MaxDecompressedSize
+	}
+	return int64(size)
 }
 
-// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
-func (m *Middleware) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+// decodeContext returns the context the body of r is decoded under. With
+// DecompressTimeout set, it ends with a 504 Gateway Timeout error once
+// the timeout has passed. A read of the body that is blocked on a stalled
+// client by then is interrupted, by moving the connection's read deadline
+// to that moment where w supports it, or else by closing the body.
+func (m *Middleware) decodeContext(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelFunc) {
+	if m.DecompressTimeout == 0 {
+		return r.Context(), func() {}
+	}
+	timeout := time.Duration(m.DecompressTimeout)
+	ctx, cancel := context.WithTimeoutCause(r.Context(), timeout, caddyhttp.Error(http.StatusGatewayTimeout,
+		withReason(reasonTimeout, fmt.Errorf("decompression took longer than %s", timeout))))
+
+	// The deadline is only moved once ctx has ended with the timeout as
+	// its cause, which the request being canceled along with the
+	// connection's read can't change anymore.
+	controller := http.NewResponseController(w)
+	body := r.Body
+	stop := context.AfterFunc(ctx, func() {
+		if controller.SetReadDeadline(time.Now()) != nil {
+			body.Close()
+		}
+	})
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// validateBody checks a decompressed body against ValidateUTF8 and
+// ValidateJSON.
+func (m *Middleware) validateBody(body []byte) error {
+	if m.ValidateUTF8 && !utf8.Valid(body) {
+		return errors.New("decompressed body is not valid UTF-8")
+	}
+	if m.ValidateJSON && !json.Valid(body) {
+		return errors.New("decompressed body is not valid JSON")
+	}
+	return nil
+}
+
+// verifyLength checks size, the length of a decompressed body, against
+// the one declared in the VerifyUncompressedLength header, if r has it.
+func (m *Middleware) verifyLength(r *http.Request, size int64) error {
+	if m.VerifyUncompressedLength == "" {
+		return nil
+	}
+	value := r.Header.Get(m.VerifyUncompressedLength)
+	if value == "" {
+		return nil
+	}
+	declared, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || declared < 0 {
+		return fmt.Errorf("invalid %s header %q", m.VerifyUncompressedLength, value)
+	}
+	if declared != size {
+		return fmt.Errorf("decompressed body is %d bytes, but %s declares %d",
+			size, m.VerifyUncompressedLength, declared)
+	}
 	return nil
 }
 
-// parseCaddyfile parses the request_decompress directive
-func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
-	var m Middleware
-	return &m, nil
+// isUpgrade reports whether r asks to switch protocols, as a WebSocket
+// handshake does, by listing "upgrade" in its Connection header. HTTP/2
+// and HTTP/3 have no such header and open WebSockets with an extended
+// CONNECT instead (RFC 8441, RFC 9220), so any CONNECT counts too: its
+// body is the tunneled stream.
+func isUpgrade(r *http.Request) bool {
+	if r.Method == http.MethodConnect {
+		return true
+	}
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesContentType reports whether the request's media type is one of
+// types. A missing or malformed Content-Type never matches.
+func matchesContentType(r *http.Request, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return slices.Contains(types, mediaType)
+}
+
+// acquireSlot takes one of the MaxConcurrent decompression slots, waiting
+// up to ConcurrencyTimeout for one to free up. It reports whether a slot
+// was taken.
+func (m *Middleware) acquireSlot(r *http.Request) bool {
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if m.ConcurrencyTimeout <= 0 {
+		return false
+	}
+
+	timer := time.NewTimer(time.Duration(m.ConcurrencyTimeout))
+	defer timer.Stop()
+	select {
+	case m.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// decodeSucceeded records and logs a request whose body was decoded.
+func (m *Middleware) decodeSucceeded(encodings []string, compressedSize, decompressedSize int64, elapsed time.Duration) {
+	m.metrics.requestSucceeded(encodings)
+	m.metrics.recordSizes(encodings, compressedSize, decompressedSize)
+	m.metrics.recordDuration(encodings, elapsed)
+
+	var ratio float64
+	if compressedSize > 0 {
+		ratio = float64(decompressedSize) / float64(compressedSize)
+	}
+	m.logger.Debug("decompressed request body",
+		zap.String("encoding", strings.Join(encodings, ", ")),
+		zap.Int64("compressed_size", compressedSize),
+		zap.Int64("decompressed_size", decompressedSize),
+		zap.Float64("ratio", ratio),
+		zap.Duration("duration", elapsed),
+	)
+	if m.OnSuccess != nil {
+		m.OnSuccess(strings.Join(encodings, ", "), compressedSize, decompressedSize)
+	}
+}
+
+// setPlaceholders publishes the outcome of a successful decode to the
+// request's replacer. They are never set for requests that were not
+// decompressed, so they resolve to empty in that case.
+func setPlaceholders(r *http.Request, encodings []string, decompressedSize int64) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Set(placeholderDecompressedSize, decompressedSize)
+	repl.Set(placeholderOriginalEncoding, strings.Join(encodings, ", "))
+}
+
+// setVars records in the request's vars, where the vars matcher and
+// {http.vars.*} placeholders can see them, that the body was decompressed
+// and what its original encoding was.
+func setVars(r *http.Request, encodings []string) {
+	caddyhttp.SetVar(r.Context(), varDecompressed, true)
+	caddyhttp.SetVar(r.Context(), varOriginalEncoding, strings.Join(encodings, ", "))
+}
+
+// setSignalHeader tells the client, with SignalHeader, that its body was
+// decompressed from encodings.
+func (m *Middleware) setSignalHeader(w http.ResponseWriter, encodings []string) {
+	if m.SignalHeader != "" {
+		w.Header().Set(m.SignalHeader, strings.Join(encodings, ", "))
+	}
+}
+
+// setBodyPlaceholder publishes the decompressed body of an inspect-only
+// request to the request's replacer.
+func setBodyPlaceholder(r *http.Request, decompressed []byte) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Set(placeholderBody, string(decompressed))
+}
+
+// fail records a request whose body could not be decompressed and rejects
+// it with status. By default the error is returned for Caddy's error
+// handling; with ErrorFormat "json" an error envelope is written instead,
+// gzip-encoded if GzipErrors is set and r accepts it.
+func (m *Middleware) fail(w http.ResponseWriter, r *http.Request, encodings []string, status int, err error) error {
+	m.decodeFailed(encodings, err)
+	switch failureReason(err) {
+	case reasonInvalidHeader:
+		w.Header().Set(decodeErrorHeader, "bad_header")
+	case reasonCorruptData:
+		w.Header().Set(decodeErrorHeader, "bad_stream")
+	}
+	if m.ErrorFormat != errorFormatJSON {
+		return caddyhttp.Error(status, err)
+	}
+
+	code := "decompression_failed"
+	switch {
+	case errors.Is(err, ErrUnsupportedEncoding):
+		code = "unsupported_encoding"
+	case status == http.StatusRequestEntityTooLarge:
+		code = "body_too_large"
+	case status == http.StatusServiceUnavailable:
+		code = "server_busy"
+	case status == http.StatusTooManyRequests:
+		code = "rate_limited"
+	case status == http.StatusGatewayTimeout:
+		code = "timeout"
+	}
+	message := err.Error()
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.Err != nil {
+		message = handlerErr.Err.Error()
+	}
+
+	envelope := errorEnvelope{
+		Error:    code,
+		Encoding: strings.Join(encodings, ", "),
+		Message:  message,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if m.GzipErrors {
+		varyAcceptEncoding(w.Header())
+		if negotiateEncoding(r.Header.Get("Accept-Encoding"), []string{"gzip"}) == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(status)
+			zw := gzip.NewWriter(w)
+			if err := json.NewEncoder(zw).Encode(envelope); err != nil {
+				return err
+			}
+			return zw.Close()
+		}
+	}
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(envelope)
+}
+
+// errorEnvelope is the body written for failed requests when ErrorFormat
+// is "json".
+type errorEnvelope struct {
+	Error    string `json:"error"`
+	Encoding string `json:"encoding"`
+	Message  string `json:"message"`
+}
+
+// decodeErrorStatus returns the status to reject a body that failed to
+// decode with. Malformed data gets the error status, but the limit
+// readers and the decompress timeout fail with their own status.
+func (m *Middleware) decodeErrorStatus(err error) int {
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) {
+		return handlerErr.StatusCode
+	}
+	return m.errorStatus()
+}
+
+// errorStatus returns the status for malformed bodies.
+func (m *Middleware) errorStatus() int {
+	if m.ErrorStatus != 0 {
+		return m.ErrorStatus
+	}
+	return http.StatusBadRequest
+}
+
+// clientAborted reports whether decoding stopped because the client went
+// away, rather than because the body was malformed: the request was
+// canceled, or reading the raw body failed. The limit readers in front of
+// the body fail with a HandlerError, which doesn't count. Neither does
+// running out of the DecompressTimeout of ctx, though interrupting the
+// read also cancels the request.
+func clientAborted(ctx context.Context, r *http.Request, body *countingReader) bool {
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(context.Cause(ctx), &handlerErr) {
+		return false
+	}
+	if r.Context().Err() != nil {
+		return true
+	}
+	return body.err != nil && !errors.As(body.err, &handlerErr)
+}
+
+// decodeAborted records and logs a request whose client went away before
+// its body was fully received.
+func (m *Middleware) decodeAborted(encodings []string, err error) {
+	m.metrics.requestAborted(encodings)
+	m.logger.Debug("client aborted request body",
+		zap.String("encoding", strings.Join(encodings, ", ")),
+		zap.Error(err),
+	)
+}
+
+// decodeFailed records and logs a request whose body could not be decoded.
+func (m *Middleware) decodeFailed(encodings []string, err error) {
+	reason := failureReason(err)
+	if reason == "" {
+		reason = reasonCorruptData
+	}
+	m.metrics.requestFailed(encodings, reason)
+	m.logger.Warn("failed to decompress request body",
+		zap.String("encoding", strings.Join(encodings, ", ")),
+		zap.String("reason", reason),
+		zap.Error(err),
+	)
+	if m.OnError != nil {
+		m.OnError(strings.Join(encodings, ", "), err)
+	}
+}
+
+// removeEncoding drops the decoded encodings from the Content-Encoding
+// header of a request whose body has been replaced with the decompressed
+// one, leaving any remaining ones, and keeps the decoded encodings in
+// PreserveEncodingHeader if configured.
+func (m *Middleware) removeEncoding(r *http.Request, encodings, remaining []string) {
+	if m.PreserveEncodingHeader != "" {
+		r.Header.Set(m.PreserveEncodingHeader, strings.Join(encodings, ", "))
+	}
+	if len(remaining) > 0 {
+		r.Header.Set(m.encodingHeader(), strings.Join(remaining, ", "))
+		return
+	}
+	r.Header.Del(m.encodingHeader())
+}
+
+// encodingHeader returns the name of the header that carries the
+// encodings, EncodingHeader or Content-Encoding.
+func (m *Middleware) encodingHeader() string {
+	if m.EncodingHeader != "" {
+		return m.EncodingHeader
+	}
+	return "Content-Encoding"
+}
+
+// canDecode reports whether encoding is built in and permitted by the
+// configuration. Every coding in a chain is checked before any decoder
+// touches the body, so that unsupported requests can still be passed
+// through intact.
+func (m *Middleware) canDecode(encoding string) bool {
+	if !slices.Contains(builtinEncodings, encoding) {
+		return m.DecoderFactory != nil && slices.Contains(m.AllowedEncodings, encoding)
+	}
+	if enabled, ok := m.EncodingToggles[encoding]; ok && !enabled {
+		return false
+	}
+	// identity applies no transformation, so there's nothing to restrict.
+	if encoding == "identity" {
+		return true
+	}
+	return len(m.AllowedEncodings) == 0 || slices.Contains(m.AllowedEncodings, encoding)
+}
+
+// encodingAliases maps legacy coding names (RFC 9110, section 8.4.1), and
+// other names clients use for a supported coding, to the names they are
+// equivalent to.
+var encodingAliases = map[string]string{
+	"x-gzip":     "gzip",
+	"x-compress": "compress",
+	"bzip2":      "bz2",
+}
+
+// parseContentEncoding splits a Content-Encoding header value into its
+// codings, in the order they were applied, normalized by parseEncoding.
+// Empty tokens are skipped.
+func parseContentEncoding(header string) []string {
+	var encodings []string
+	for _, token := range strings.Split(header, ",") {
+		if encoding, ok := parseEncoding(token); ok {
+			encodings = append(encodings, encoding)
+		}
+	}
+	return encodings
+}
+
+// legacyBase64Order moves a base64 coding that leads a chain of several
+// to its end, where the standard order has the coding applied last.
+func legacyBase64Order(encodings []string) []string {
+	if len(encodings) < 2 || encodings[0] != "base64" {
+		return encodings
+	}
+	return append(slices.Clone(encodings[1:]), "base64")
+}
+
+// parseEncoding normalizes a single coding token, so that the same coding
+// is always decoded, allowed and counted under the same name however a
+// client spelled it. It trims whitespace, drops parameters such as ";q=1",
+// unquotes quoted tokens, lowercases and replaces legacy aliases with
+// their canonical names. It reports false for an empty token.
+func parseEncoding(token string) (string, bool) {
+	token, _, _ = strings.Cut(token, ";")
+	token = strings.TrimSpace(token)
+	if len(token) >= 2 && token[0] == '"' && token[len(token)-1] == '"' {
+		token = strings.TrimSpace(token[1 : len(token)-1])
+	}
+	if token == "" {
+		return "", false
+	}
+	token = strings.ToLower(token)
+	if canonical, ok := encodingAliases[token]; ok {
+		token = canonical
+	}
+	return token, true
+}
+
+// Placeholders set after a successful decode.
+const (
+	placeholderDecompressedSize = "http.request_decompress.decompressed_size"
+	placeholderOriginalEncoding = "http.request_decompress.original_encoding"
+	placeholderBody             = "http.request_decompress.body" // only with InspectOnly
+)
+
+// Request vars set after a body is decompressed, or is about to be in
+// Stream mode.
+const (
+	varDecompressed     = "request_decompress.decompressed"
+	varOriginalEncoding = "request_decompress.original_encoding"
+)
+
+// defaultBufferSize is the read buffer size used when BufferSize is unset.
+const defaultBufferSize = 32 << 10
+
+// defaultTrustSizeHeader is the header the Caddyfile's trust_size_header
+// option uses when no name is given.
+const defaultTrustSizeHeader = "X-Max-Decompressed-Size"
+
+// defaultVerifyLengthHeader is the header the Caddyfile's
+// verify_uncompressed_length option uses when no name is given.
+const defaultVerifyLengthHeader = "X-Uncompressed-Length"
+
+// defaultDecodeQuery is the query parameter the Caddyfile's
+// trust_decode_query option uses when no name is given.
+const defaultDecodeQuery = "_decode"
+
+// defaultSignalHeader is the header the Caddyfile's signal_header option
+// uses when no name is given.
+const defaultSignalHeader = "X-Request-Decompressed"
+
+// defaultPreserveEncodingHeader is the header the Caddyfile's
+// preserve_encoding_header option uses when no name is given.
+const defaultPreserveEncodingHeader = "X-Original-Content-Encoding"
+
+// statusClientClosedRequest is the nginx-style status for requests whose
+// client closed the connection before the body was received.
+const statusClientClosedRequest = 499
+
+// Values of OnUnsupported.
+const (
+	unsupportedReject      = "reject"
+	unsupportedPassthrough = "passthrough"
+)
+
+// Values of PartialChain.
+const (
+	partialChainReject      = "reject"
+	partialChainPassthrough = "passthrough"
+)
+
+// Values of OnOversize.
+const (
+	oversizeReject   = "reject"
+	oversizeTruncate = "truncate"
+)
+
+// decodeErrorHeader is set on responses to bodies that failed to decode,
+// to tell a malformed header of the encoded data, which usually means the
+// body was labeled with the wrong encoding, from a corrupt or truncated
+// stream after it.
+const decodeErrorHeader = "X-Decompress-Error"
+
+// truncatedHeader is set on requests whose body was cut off at
+// MaxDecompressedSize.
+const truncatedHeader = "X-Decompress-Truncated"
+
+// Values of ErrorFormat.
+const (
+	errorFormatCaddy = "caddy"
+	errorFormatJSON  = "json"
+)
+
+// snappyStreamIdentifier is the chunk every Snappy framing format stream
+// starts with.
+var snappyStreamIdentifier = []byte("\xff\x06\x00\x00sNaPpY")
+
+// magicNumbers maps encodings to the leading bytes of their streams.
+var magicNumbers = []struct {
+	encoding string
+	magic    []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"bz2", []byte("BZh")},
+	{"lz4", []byte{0x04, 0x22, 0x4d, 0x18}},
+	{"snappy", snappyStreamIdentifier[:4]},
+	{"compress", []byte{0x1f, 0x9d}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// maxMagicLen is the length of the longest entry in magicNumbers.
+const maxMagicLen = 6
+
+// peekBufferSize is the size of the buffer used to peek at the start of a
+// body. It is bufio's minimum, so peeking reads as little ahead as
+// possible.
+const peekBufferSize = 16
+
+// maxMinSizePeek is the largest MinSize for which bodies of unknown
+// length are read ahead, bounding the memory that takes per request.
+const maxMinSizePeek = 64 << 10
+
+// bodyShorterThan reports whether a body of unknown length ends before n
+// bytes, peeking at up to n bytes of it. The body is replaced with one that
+// still yields the peeked bytes. For n above maxMinSizePeek it doesn't
+// read anything and reports false.
+func bodyShorterThan(r *http.Request, n int64) bool {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	if n > maxMinSizePeek {
+		return false
+	}
+	buffered := bufio.NewReaderSize(r.Body, int(n))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{buffered, r.Body}
+
+	_, err := buffered.Peek(int(n))
+	return err == io.EOF
+}
+
+// isEmptyBody reports whether the request has no body. When the length is
+// unknown it peeks at the body, which is replaced with one that still
+// yields the peeked byte.
+func isEmptyBody(r *http.Request) bool {
+	if r.ContentLength >= 0 {
+		return r.ContentLength == 0
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return true
+	}
+	buffered := bufio.NewReaderSize(r.Body, peekBufferSize)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{buffered, r.Body}
+
+	_, err := buffered.Peek(1)
+	return err == io.EOF
+}
+
+// sniffEncoding peeks at the start of the request body and returns the
+// encoding whose magic number it begins with, or "" if none match. Only
+// encodings built into this build are looked for. The body is replaced with one that still yields the peeked bytes, and that
+// reads ahead no further than it has to, since it is forwarded as it is if
+// nothing matches.
+func sniffEncoding(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	buffered := bufio.NewReaderSize(r.Body, peekBufferSize)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{buffered, r.Body}
+
+	header, _ := buffered.Peek(maxMagicLen)
+	for _, format := range magicNumbers {
+		if slices.Contains(builtinEncodings, format.encoding) && bytes.HasPrefix(header, format.magic) {
+			return format.encoding
+		}
+	}
+	return ""
+}
+
+// newDecoderChain returns a reader that undoes every coding in encodings,
+// which are listed in the order they were applied to src. The last coding
+// applied is therefore the first one decoded.
+func (m *Middleware) newDecoderChain(encodings []string, src io.Reader) (io.ReadCloser, error) {
+	chain := &decoderChain{Reader: src}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoder, err := m.newDecoder(encodings[i], chain.Reader)
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		chain.Reader = decoder
+		chain.decoders = append(chain.decoders, decoder)
+	}
+	return chain, nil
+}
+
+// decoderChain reads through a stack of decoders, each one reading from
+// the decoder before it.
+type decoderChain struct {
+	io.Reader
+	decoders []io.ReadCloser
+}
+
+// Close implements io.Closer. It closes every decoder in the chain,
+// starting with the innermost, and returns the first error encountered.
+func (c *decoderChain) Close() error {
+	var err error
+	for i := len(c.decoders) - 1; i >= 0; i-- {
+		if closeErr := c.decoders[i].Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// newDecoder returns a reader that decompresses src according to encoding.
+// Closing the returned reader releases the decoder but not src.
+func (m *Middleware) newDecoder(encoding string, src io.Reader) (io.ReadCloser, error) {
+	if m.DecoderFactory != nil {
+		decoder, err := m.DecoderFactory(encoding, src)
+		if !errors.Is(err, ErrUnsupportedEncoding) {
+			return decoder, err
+		}
+	}
+
+	decode, ok := m.decoders[encoding]
+	if !ok {
+		return nil, unsupportedEncodingError(encoding)
+	}
+	return decode(src)
+}
+
+// OriginalBodyCtxKey is the context key under which RetainOriginal keeps
+// the compressed body of a decompressed request, as a []byte.
+const OriginalBodyCtxKey caddy.CtxKey = "request_decompress.original_body"
+
+// ErrUnsupportedEncoding is wrapped by the error returned for requests
+// using an encoding that is unknown or not allowed.
+var ErrUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// unsupportedEncodingError returns the error for a coding that can't, or
+// may not, be decoded.
+func unsupportedEncodingError(encoding string) error {
+	return fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+// Reasons a request is counted as failed, as reported in metrics and logs.
+const (
+	reasonUnsupportedEncoding = "unsupported_encoding"
+	reasonTooManyLayers       = "too_many_layers"
+	reasonInvalidHeader       = "invalid_header"
+	reasonCorruptData         = "corrupt_data"
+	reasonCompressedSize      = "compressed_size_limit"
+	reasonSizeLimit           = "size_limit"
+	reasonRatioLimit          = "ratio_limit"
+	reasonTimeout             = "timeout"
+	reasonRateLimited         = "rate_limited"
+	reasonBusy                = "busy"
+	reasonInvalidBody         = "invalid_body"
+	reasonLengthMismatch      = "length_mismatch"
+)
+
+// reasonError tags an error with the reason the request failed. It reads
+// exactly like the error it wraps.
+type reasonError struct {
+	error
+	reason string
+}
+
+func (e reasonError) Unwrap() error { return e.error }
+
+func withReason(reason string, err error) error {
+	return reasonError{error: err, reason: reason}
+}
+
+// headerError tags an error from setting up a decoder, which is when the
+// header of the encoded data is read, unless it already has a reason.
+func headerError(err error) error {
+	if failureReason(err) != "" {
+		return err
+	}
+	return withReason(reasonInvalidHeader, fmt.Errorf("malformed encoding header: %w", err))
+}
+
+// streamError tags an error from reading a decoder, which is when the
+// encoded stream after the header is decoded, unless it already has a
+// reason.
+func streamError(err error) error {
+	if failureReason(err) != "" {
+		return err
+	}
+	return withReason(reasonCorruptData, fmt.Errorf("corrupt encoded stream: %w", err))
+}
+
+// failureReason returns the reason err was tagged with, or "" if it has
+// none. Errors from the decoders themselves are untagged.
+func failureReason(err error) string {
+	var tagged reasonError
+	if errors.As(err, &tagged) {
+		return tagged.reason
+	}
+	if errors.Is(err, ErrUnsupportedEncoding) {
+		return reasonUnsupportedEncoding
+	}
+	return ""
+}
+
+// sizeLimitedReader fails with 413 Request Entity Too Large once more than
+// limit bytes have been read from the wrapped decoder. If truncate is set,
+// it ends the body at limit bytes instead.
+type sizeLimitedReader struct {
+	io.ReadCloser
+	limit     int64
+	read      int64
+	truncate  bool
+	truncated bool
+}
+
+// Read implements io.Reader.
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.truncated {
+		return 0, io.EOF
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		n -= int(l.read - l.limit)
+		l.read = l.limit
+		if l.truncate {
+			l.truncated = true
+			return n, io.EOF
+		}
+		return n, caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			withReason(reasonSizeLimit, fmt.Errorf("decompressed body exceeds %d bytes", l.limit)))
+	}
+	return n, err
+}
+
+// compressedLimitedReader fails with 413 Request Entity Too Large once
+// more than limit bytes have been read from a body of unknown length.
+type compressedLimitedReader struct {
+	io.Reader
+	limit int64
+	read  int64
+}
+
+// Read implements io.Reader.
+func (l *compressedLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		n -= int(l.read - l.limit)
+		l.read = l.limit
+		return n, caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			withReason(reasonCompressedSize, fmt.Errorf("compressed body exceeds %d bytes", l.limit)))
+	}
+	return n, err
+}
+
+// contextReader stops reading from the wrapped decoder with the context's
+// cause once ctx is done, so a canceled request doesn't keep decoding.
+// Errors from a read that was interrupted because ctx ended, such as by
+// the body being closed, are reported as that cause too.
+type contextReader struct {
+	io.ReadCloser
+	ctx context.Context
+}
+
+// Read implements io.Reader.
+func (c *contextReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	n, err := c.ReadCloser.Read(p)
+	if err != nil && c.ctx.Err() != nil {
+		return n, context.Cause(c.ctx)
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it and remembers the
+// first error other than io.EOF.
+type countingReader struct {
+	io.Reader
+	n   int64
+	err error
+}
+
+// Read implements io.Reader.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// ratioGracePeriod is how many bytes may be decompressed before MaxRatio
+// is enforced. Small bodies can legitimately compress extremely well.
+const ratioGracePeriod = 1 << 20
+
+// ratioLimitedReader fails with 400 Bad Request once the bytes read from
+// the wrapped decoder exceed maxRatio times the compressed bytes consumed.
+type ratioLimitedReader struct {
+	io.ReadCloser
+	compressed *countingReader
+	maxRatio   float64
+	read       int64
+}
+
+// Read implements io.Reader.
+func (l *ratioLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.read += int64(n)
+	if l.read > ratioGracePeriod && float64(l.read) > l.maxRatio*float64(max(l.compressed.n, 1)) {
+		return n, caddyhttp.Error(http.StatusBadRequest,
+			withReason(reasonRatioLimit, fmt.Errorf("decompressed body exceeds %gx expansion ratio", l.maxRatio)))
+	}
+	return n, err
+}
+
+// decompressReader is the request body used in streaming mode. Reads are
+// served by the decoder, and closing it closes both the decoder and the
+// original request body. onDone is called once, with the decompressed size,
+// when the decoder has been read to the end or has failed, and stop after
+// it or on Close, whichever comes first, to end the decode timeout.
+type decompressReader struct {
+	io.ReadCloser
+	body   io.Closer
+	onDone func(decompressedSize int64, err error)
+	stop   func()
+	read   int64
+}
+
+// Read implements io.Reader.
+func (d *decompressReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	d.read += int64(n)
+	if err != nil && d.onDone != nil {
+		if err == io.EOF {
+			d.onDone(d.read, nil)
+		} else {
+			d.onDone(d.read, err)
+		}
+		d.onDone = nil
+		d.stopTimeout()
+	}
+	return n, err
+}
+
+// Close implements io.Closer.
+func (d *decompressReader) Close() error {
+	d.stopTimeout()
+	err := d.ReadCloser.Close()
+	if bodyErr := d.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
+
+// stopTimeout ends the decode timeout, if it hasn't been already.
+func (d *decompressReader) stopTimeout() {
+	if d.stop != nil {
+		d.stop()
+		d.stop = nil
+	}
 }
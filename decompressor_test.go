@@ -0,0 +1,871 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/klauspost/compress/zstd"
+)
+
+// FuzzServeHTTP sends arbitrary bodies with arbitrary Content-Encoding
+// values through ServeHTTP, which must answer every one with success or a
+// client error, and never panic. The corpus starts from a valid body for
+// each built-in codec, and run with -fuzz it goes on to mangle them.
+func FuzzServeHTTP(f *testing.F) {
+	for _, encoding := range builtinEncodings {
+		f.Add(encoding, encodeSample(f, encoding, samplePlain))
+	}
+	if decoderFactories["base64"] != nil {
+		f.Add("gzip, base64", encodeSample(f, "base64", encodeSample(f, "gzip", samplePlain)))
+	}
+	f.Add("", encodeSample(f, "gzip", samplePlain)) // sniffed
+	f.Add("", samplePlain)
+	f.Add("br", samplePlain)
+	f.Add("gzip;q=0.5, , zstd", []byte{})
+
+	m := provisionTest(f, &Middleware{MaxDecompressedSize: 1 << 20, Sniff: true})
+	next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error { return nil })
+
+	f.Fuzz(func(t *testing.T, encoding string, body []byte) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.Header.Set("Content-Encoding", encoding)
+		r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		err := m.ServeHTTP(httptest.NewRecorder(), r, next)
+		if err == nil {
+			return
+		}
+		var handlerErr caddyhttp.HandlerError
+		if !errors.As(err, &handlerErr) {
+			t.Fatalf("Content-Encoding %q: got %v, want a HandlerError", encoding, err)
+		}
+		if handlerErr.StatusCode < 400 || handlerErr.StatusCode >= 500 {
+			t.Fatalf("Content-Encoding %q: got status %d, want a client error: %v", encoding, handlerErr.StatusCode, err)
+		}
+	})
+}
+
+func TestParseEncoding(t *testing.T) {
+	tests := []struct {
+		token  string
+		want   string
+		wantOK bool
+	}{
+		{"gzip", "gzip", true},
+		{"  GZip\t", "gzip", true},
+		{"gzip;q=0.5", "gzip", true},
+		{"gzip ; q=1 ; level=9", "gzip", true},
+		{`"zstd"`, "zstd", true},
+		{` " Zstd " ;q=1`, "zstd", true},
+		{"x-gzip", "gzip", true},
+		{"X-Compress", "compress", true},
+		{"bzip2", "bz2", true},
+		{"br", "br", true},
+		{"", "", false},
+		{"   ", "", false},
+		{";q=1", "", false},
+		{`""`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseEncoding(tt.token)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseEncoding(%q) = %q, %t; want %q, %t", tt.token, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseContentEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"gzip", []string{"gzip"}},
+		{"gzip, base64", []string{"gzip", "base64"}},
+		{"GZIP,BASE64", []string{"gzip", "base64"}},
+		{"gzip;q=1, zstd ;q=0.5", []string{"gzip", "zstd"}},
+		{`"gzip", "zstd"`, []string{"gzip", "zstd"}},
+		{", gzip,, ,zstd,", []string{"gzip", "zstd"}},
+		{" , ,", nil},
+		{"x-gzip, identity", []string{"gzip", "identity"}},
+	}
+	for _, tt := range tests {
+		if got := parseContentEncoding(tt.header); !slices.Equal(got, tt.want) {
+			t.Errorf("parseContentEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+// TestContentEncodingHeader checks that however a coding list is written,
+// over one header line or several, it is decoded in the order it was
+// applied and counted under the codings' canonical names.
+func TestContentEncodingHeader(t *testing.T) {
+	if decoderFactories["base64"] == nil {
+		t.Skip("base64 is not built in")
+	}
+	body := encodeSample(t, "base64", encodeSample(t, "gzip", samplePlain))
+	for _, lines := range [][]string{
+		{"gzip, base64"},
+		{" X-GZIP ;q=1 , \"base64\" "},
+		{"gzip", "base64"},
+		{"gzip,", "", " , base64"},
+	} {
+		t.Run(strings.Join(lines, "|"), func(t *testing.T) {
+			m := &Middleware{}
+			h, next := newTestHandler(t, m)
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			r.Header["Content-Encoding"] = lines
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := next.last().body; !bytes.Equal(got, samplePlain) {
+				t.Errorf("got body %q, want %q", got, samplePlain)
+			}
+			s := snapshot(m)
+			if len(s.RequestsByEncoding) != 2 || s.RequestsByEncoding["gzip"] != 1 || s.RequestsByEncoding["base64"] != 1 {
+				t.Errorf("got requests by encoding %v, want one each of gzip and base64", s.RequestsByEncoding)
+			}
+		})
+	}
+}
+
+// TestProvisionJSON loads the handler from raw JSON the way Caddy's JSON
+// config does, which provisions and validates it. Between them the configs
+// set every option, each of which must survive the round trip back to JSON.
+// Some options rule others out, hence more than one config.
+func TestProvisionJSON(t *testing.T) {
+	for _, encoding := range []string{"base64", "deflate", "xz", "zstd"} {
+		if decoderFactories[encoding] == nil {
+			t.Skipf("%s is not built in", encoding)
+		}
+	}
+	dir := t.TempDir()
+	zstdDict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       42,
+		Contents: [][]byte{samplePlain, []byte(`{"jsonrpc":"2.0","method":"eth_chainId"}`)},
+		History:  samplePlain,
+		Offsets:  [3]int{1, 4, 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstdDictPath := filepath.Join(dir, "dict.zstd")
+	deflateDictPath := filepath.Join(dir, "dict.deflate")
+	for path, data := range map[string][]byte{zstdDictPath: zstdDict, deflateDictPath: samplePlain} {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	configs := map[string]string{
+		"buffered": fmt.Sprintf(`{
+			"retain_original": true,
+			"sample_rate": 0.5,
+			"tee_to": %q,
+			"legacy_base64_order": true,
+			"max_size": 1048576,
+			"trust_size_header": "X-Uncompressed-Size",
+			"trust_decode_query": "decode",
+			"max_compressed_size": 524288,
+			"max_ratio": 100,
+			"min_size": 16,
+			"max_encoding_layers": 2,
+			"encodings": ["gzip", "zstd", "deflate", "base64"],
+			"encoding_toggles": {"xz": false},
+			"sniff": true,
+			"match_path": ["/api/*"],
+			"methods": ["POST", "PUT"],
+			"content_types": ["application/json"],
+			"skip_content_types": ["image/*"],
+			"require_header": "X-Compressed",
+			"grpc_web": true,
+			"multipart": true,
+			"encoding_header": "X-Content-Encoding",
+			"preserve_encoding_header": "X-Original-Encoding",
+			"signal_header": "X-Decompressed",
+			"on_unsupported": "passthrough",
+			"partial_chain": "reject",
+			"on_oversize": "truncate",
+			"force_chunked": true,
+			"recompress_to": "zstd",
+			"buffer_size": 65536,
+			"error_format": "json",
+			"gzip_errors": true,
+			"error_status": 422,
+			"validate_utf8": true,
+			"validate_json": true,
+			"json_prefix": true,
+			"verify_uncompressed_length": "X-Original-Length",
+			"max_concurrent": 8,
+			"concurrency_timeout": 2000000000,
+			"decompress_timeout": 5000000000,
+			"rate_limit_per_ip": 10,
+			"trusted_proxies": ["10.0.0.0/8"],
+			"cache_idempotent_size": 1048576,
+			"cache_idempotent_ttl": 60000000000,
+			"gzip_multistream": false,
+			"zstd_dict": %q,
+			"zstd_concurrency": 2,
+			"deflate_dict": %q,
+			"compress_response": ["gzip"],
+			"debug": true
+		}`, filepath.Join(dir, "tee.log"), zstdDictPath, deflateDictPath),
+		"stream": `{
+			"observe": true,
+			"stream": true,
+			"peel_one": true,
+			"partial_chain": "passthrough"
+		}`,
+		"inspect": `{"inspect_only": true}`,
+	}
+
+	set := make(map[string]bool)
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			module, err := ctx.LoadModuleByID("http.handlers.request_decompressor", json.RawMessage(config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := module.(*Middleware)
+
+			var want, got map[string]any
+			if err := json.Unmarshal([]byte(config), &want); err != nil {
+				t.Fatal(err)
+			}
+			roundTrip, err := json.Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(roundTrip, &got); err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range want {
+				set[key] = true
+				if !reflect.DeepEqual(got[key], value) {
+					t.Errorf("%s: got %v, want %v", key, got[key], value)
+				}
+			}
+
+			if name != "buffered" {
+				return
+			}
+			if m.pathMatcher == nil || m.limiters == nil || m.cache == nil || m.tee == nil {
+				t.Error("path matcher, rate limiters, cache and tee not all set up")
+			}
+			if cap(m.slots) != 8 || len(m.trustedProxies) != 1 {
+				t.Errorf("got %d slots and %d trusted proxies, want 8 and 1", cap(m.slots), len(m.trustedProxies))
+			}
+			if m.zstdDictID != 42 {
+				t.Errorf("got zstd dictionary %d, want 42", m.zstdDictID)
+			}
+		})
+	}
+
+	fields := reflect.TypeFor[Middleware]()
+	for i := range fields.NumField() {
+		key, _, _ := strings.Cut(fields.Field(i).Tag.Get("json"), ",")
+		if key != "" && key != "-" && !set[key] {
+			t.Errorf("no config sets %s", key)
+		}
+	}
+}
+
+// TestInvalidBody checks that a body that isn't in its declared encoding
+// is rejected with 400 and attributed to that encoding, in the response
+// and in the metrics. br is not built in, so it is rejected as
+// unsupported and counted as "other".
+func TestInvalidBody(t *testing.T) {
+	garbage := []byte("\xff\xfenot a compressed body!")
+	for _, encoding := range append(slices.Clone(builtinEncodings), "br") {
+		if encoding == "identity" {
+			continue
+		}
+		t.Run(encoding, func(t *testing.T) {
+			m := &Middleware{ErrorFormat: errorFormatJSON}
+			h, next := newTestHandler(t, m)
+			w := postBody(h, encoding, bytes.NewReader(garbage))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			if next.calls() != 0 {
+				t.Error("next handler called")
+			}
+
+			var envelope errorEnvelope
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("decoding error body %q: %v", w.Body, err)
+			}
+			wantError, label := "decompression_failed", encoding
+			if encoding == "br" {
+				wantError, label = "unsupported_encoding", "other"
+			}
+			if envelope.Error != wantError || envelope.Encoding != encoding {
+				t.Errorf("got error %q for %q, want %q for %q", envelope.Error, envelope.Encoding, wantError, encoding)
+			}
+
+			s := snapshot(m)
+			if s.TotalRequests != 1 || s.FailedRequests != 1 {
+				t.Errorf("got %d requests and %d failures, want 1 of each", s.TotalRequests, s.FailedRequests)
+			}
+			if got := s.RequestsByEncoding[label]; got != 1 {
+				t.Errorf("got %d requests counted as %q, want 1", got, label)
+			}
+		})
+	}
+}
+
+// TestTruncatedBody checks that a body cut off after a valid header is
+// rejected as a bad stream rather than forwarded short, at several
+// offsets. base64 and compress have no end marker to miss, and identity
+// nothing to decode, so they are left out.
+func TestTruncatedBody(t *testing.T) {
+	for _, encoding := range builtinEncodings {
+		switch encoding {
+		case "base64", "compress", "identity":
+			continue
+		}
+		encoded := encodeSample(t, encoding, samplePlain)
+		for _, cut := range []int{len(encoded) / 2, len(encoded) * 3 / 4, len(encoded) - 1} {
+			t.Run(encoding+"/"+strconv.Itoa(cut), func(t *testing.T) {
+				m := &Middleware{}
+				h, next := newTestHandler(t, m)
+				w := postBody(h, encoding, bytes.NewReader(encoded[:cut]))
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+				}
+				if got := w.Header().Get(decodeErrorHeader); got != "bad_stream" {
+					t.Errorf("got %s %q, want %q", decodeErrorHeader, got, "bad_stream")
+				}
+				if next.calls() != 0 {
+					t.Error("next handler called")
+				}
+				if got := snapshot(m).FailuresByReason[reasonCorruptData]; got != 1 {
+					t.Errorf("got %d %s failures, want 1", got, reasonCorruptData)
+				}
+			})
+			t.Run(encoding+"/"+strconv.Itoa(cut)+"/stream", func(t *testing.T) {
+				h, next := newTestHandler(t, &Middleware{Stream: true})
+				postBody(h, encoding, bytes.NewReader(encoded[:cut]))
+				if rec := next.last(); rec.err == nil {
+					t.Errorf("next handler read %d bytes without an error", len(rec.body))
+				}
+			})
+		}
+	}
+}
+
+// TestNoGoroutineLeak checks that bodies given up on midway leave no
+// goroutines behind once their requests end: bodies whose client goes away
+// or that are cut short, decoded with zstd_concurrency and tee_to, and
+// streamed bodies the next handler stops reading without closing them.
+func TestNoGoroutineLeak(t *testing.T) {
+	if decoderFactories["zstd"] == nil {
+		t.Skip("zstd is not built in")
+	}
+	encoded := encodeSample(t, "zstd", benchPayload(256<<10))
+
+	t.Run("buffered", func(t *testing.T) {
+		h, _ := newTestHandler(t, &Middleware{
+			ZstdConcurrency: 4,
+			TeeTo:           filepath.Join(t.TempDir(), "tee.log"),
+		})
+		checkGoroutines(t, func() {
+			for i := range 20 {
+				body := io.Reader(bytes.NewReader(encoded[:len(encoded)/2]))
+				if i%2 == 0 {
+					body = &brokenBody{data: encoded[:len(encoded)/2], err: errors.New("connection reset by peer")}
+				}
+				if w := postBody(h, "zstd", body); w.Code == http.StatusOK {
+					t.Error("body given up on accepted")
+				}
+			}
+		})
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		m := provisionTest(t, &Middleware{Stream: true})
+		h := m.WithNext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body.Read(make([]byte, 1024))
+		}))
+		checkGoroutines(t, func() {
+			for range 20 {
+				postBody(h, "zstd", bytes.NewReader(encoded))
+			}
+		})
+	})
+}
+
+// checkGoroutines fails t if there are more goroutines after run than
+// before, once those on their way out have had a moment to exit.
+func checkGoroutines(t *testing.T, run func()) {
+	t.Helper()
+	before := runtime.NumGoroutine()
+	run()
+	after := runtime.NumGoroutine()
+	for deadline := time.Now().Add(2 * time.Second); after > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+	}
+	if after > before {
+		t.Errorf("%d goroutines left behind", after-before)
+	}
+}
+
+// TestHTTPVersions checks that requests are handled alike over HTTP/1.1,
+// HTTP/2 and HTTP/3, sent without a Content-Length as HTTP/2 and HTTP/3
+// bodies often are and chunked HTTP/1.1 ones always are, and that each
+// protocol's way of opening a WebSocket is passed through.
+func TestHTTPVersions(t *testing.T) {
+	encoded := encodeSample(t, "gzip", samplePlain)
+	tiny := encodeSample(t, "gzip", []byte("hi"))
+
+	for major := 1; major <= 3; major++ {
+		// newRequest returns a POST of body with an unknown length.
+		newRequest := func(body []byte) *http.Request {
+			r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+			r.Proto, r.ProtoMajor, r.ProtoMinor = fmt.Sprintf("HTTP/%d.0", major), major, 0
+			if major == 1 {
+				r.Proto, r.ProtoMinor = "HTTP/1.1", 1
+				r.TransferEncoding = []string{"chunked"}
+			}
+			r.ContentLength = -1
+			r.Header.Set("Content-Encoding", "gzip")
+			return r
+		}
+		serve := func(t *testing.T, m *Middleware, r *http.Request) (*httptest.ResponseRecorder, *recordingHandler) {
+			h, next := newTestHandler(t, m)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			return w, next
+		}
+
+		t.Run(fmt.Sprintf("HTTP/%d", major), func(t *testing.T) {
+			t.Run("decoded", func(t *testing.T) {
+				w, next := serve(t, &Middleware{}, newRequest(encoded))
+				rec := next.last()
+				if w.Code != http.StatusOK || !bytes.Equal(rec.body, samplePlain) {
+					t.Fatalf("got status %d and body %q, want %d and %q", w.Code, rec.body, http.StatusOK, samplePlain)
+				}
+				if rec.contentLength != int64(len(samplePlain)) || rec.header.Get("Content-Encoding") != "" {
+					t.Errorf("got Content-Length %d and Content-Encoding %q, want %d and none",
+						rec.contentLength, rec.header.Get("Content-Encoding"), len(samplePlain))
+				}
+			})
+
+			t.Run("empty", func(t *testing.T) {
+				w, next := serve(t, &Middleware{}, newRequest(nil))
+				if rec := next.last(); w.Code != http.StatusOK || rec.contentLength != 0 || len(rec.body) != 0 {
+					t.Errorf("got status %d, Content-Length %d and body %q, want %d, 0 and none",
+						w.Code, rec.contentLength, rec.body, http.StatusOK)
+				}
+			})
+
+			t.Run("min_size", func(t *testing.T) {
+				m := &Middleware{MinSize: int64(len(tiny)) + 1}
+				_, next := serve(t, m, newRequest(tiny))
+				if rec := next.last(); !bytes.Equal(rec.body, tiny) || rec.header.Get("Content-Encoding") != "gzip" {
+					t.Errorf("body below min_size not passed through: got %q with Content-Encoding %q",
+						rec.body, rec.header.Get("Content-Encoding"))
+				}
+				_, next = serve(t, m, newRequest(encoded))
+				if rec := next.last(); !bytes.Equal(rec.body, samplePlain) {
+					t.Errorf("body above min_size not decoded: got %q", rec.body)
+				}
+			})
+
+			t.Run("max_compressed_size", func(t *testing.T) {
+				m := &Middleware{MaxCompressedSize: int64(len(encoded)) - 1}
+				w, next := serve(t, m, newRequest(encoded))
+				if w.Code != http.StatusRequestEntityTooLarge || next.calls() != 0 {
+					t.Errorf("got status %d and %d calls to the next handler, want %d and none",
+						w.Code, next.calls(), http.StatusRequestEntityTooLarge)
+				}
+			})
+
+			t.Run("websocket", func(t *testing.T) {
+				r := newRequest(encoded)
+				switch major {
+				case 1:
+					r.Method = http.MethodGet
+					r.Header.Set("Connection", "Upgrade")
+					r.Header.Set("Upgrade", "websocket")
+				case 2:
+					r.Method = http.MethodConnect
+					r.Header.Set(":protocol", "websocket")
+				case 3:
+					r.Method = http.MethodConnect
+					r.Proto = "websocket"
+				}
+				_, next := serve(t, &Middleware{}, r)
+				if rec := next.last(); !bytes.Equal(rec.body, encoded) || rec.header.Get("Content-Encoding") != "gzip" {
+					t.Errorf("upgrade not passed through: got %q with Content-Encoding %q",
+						rec.body, rec.header.Get("Content-Encoding"))
+				}
+			})
+		})
+	}
+}
+
+// TestDecodeTimings checks that the time spent decoding is added to the
+// total and to the chain of encodings it was spent on.
+func TestDecodeTimings(t *testing.T) {
+	payload := benchPayload(64 << 10)
+	m := &Middleware{}
+	h, _ := newTestHandler(t, m)
+
+	before := snapshot(m)
+	if w := postBody(h, "gzip", bytes.NewReader(encodeSample(t, "gzip", payload))); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	after := snapshot(m)
+	if after.DecompressionSeconds <= before.DecompressionSeconds {
+		t.Errorf("decompression seconds went from %g to %g, want an increase", before.DecompressionSeconds, after.DecompressionSeconds)
+	}
+	if after.SecondsByEncoding["gzip"] <= 0 {
+		t.Errorf("got %g seconds for gzip, want more than 0", after.SecondsByEncoding["gzip"])
+	}
+
+	if decoderFactories["base64"] == nil {
+		return
+	}
+	body := encodeSample(t, "base64", encodeSample(t, "gzip", payload))
+	if w := postBody(h, "gzip, base64", bytes.NewReader(body)); w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	after, before = snapshot(m), after
+	if after.SecondsByEncoding["gzip, base64"] <= 0 || after.SecondsByEncoding["gzip"] != before.SecondsByEncoding["gzip"] {
+		t.Errorf("got seconds by encoding %v, want the chain timed apart from gzip alone", after.SecondsByEncoding)
+	}
+}
+
+// TestEmptyBody checks that an empty body is forwarded as an empty
+// decoded one and counted as a success in every encoding, whether its
+// Content-Length says 0 or it has none.
+func TestEmptyBody(t *testing.T) {
+	for _, encoding := range builtinEncodings {
+		for _, length := range []int64{0, -1} {
+			t.Run(fmt.Sprintf("%s/%d", encoding, length), func(t *testing.T) {
+				m := &Middleware{}
+				h, next := newTestHandler(t, m)
+				r := httptest.NewRequest(http.MethodPost, "/", http.NoBody)
+				if length < 0 {
+					r.Body = io.NopCloser(bytes.NewReader(nil))
+				}
+				r.ContentLength = length
+				r.Header.Set("Content-Encoding", encoding)
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != http.StatusOK {
+					t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+				}
+				rec := next.last()
+				if len(rec.body) != 0 || rec.contentLength != 0 {
+					t.Errorf("got body %q and Content-Length %d, want neither", rec.body, rec.contentLength)
+				}
+				if got := rec.header.Get("Content-Encoding"); got != "" {
+					t.Errorf("got Content-Encoding %q, want none", got)
+				}
+				if s := snapshot(m); s.SuccessfulRequests != 1 {
+					t.Errorf("got %d successful requests, want 1", s.SuccessfulRequests)
+				}
+			})
+		}
+	}
+}
+
+// TestPassthroughUnbuffered checks that requests that aren't decoded
+// reach the next handler with the very body the client sent, unread, so
+// it streams to the upstream byte for byte.
+func TestPassthroughUnbuffered(t *testing.T) {
+	encoded := encodeSample(t, "gzip", samplePlain)
+	tests := []struct {
+		name     string
+		config   Middleware
+		encoding string
+		prepare  func(r *http.Request)
+	}{
+		{name: "uncompressed"},
+		{name: "match_path", config: Middleware{MatchPath: []string{"/api/*"}}},
+		{name: "methods", config: Middleware{Methods: []string{http.MethodPut}}},
+		{name: "content_types", config: Middleware{ContentTypes: []string{"application/json"}}},
+		{
+			name:    "skip_content_types",
+			config:  Middleware{SkipContentTypes: []string{"application/octet-stream"}},
+			prepare: func(r *http.Request) { r.Header.Set("Content-Type", "application/octet-stream") },
+		},
+		{name: "require_header", config: Middleware{RequireHeader: "X-Compressed"}},
+		{name: "min_size", config: Middleware{MinSize: int64(len(encoded)) + 1}},
+		{name: "sample_rate", config: Middleware{SampleRate: 1e-12}},
+		{name: "observe", config: Middleware{Observe: true}},
+		{name: "recompress_to", config: Middleware{RecompressTo: "gzip"}},
+		{name: "on_unsupported", config: Middleware{OnUnsupported: unsupportedPassthrough}, encoding: "br"},
+		{
+			name:    "upgrade",
+			prepare: func(r *http.Request) { r.Header.Set("Connection", "Upgrade"); r.Header.Set("Upgrade", "websocket") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoding := tt.encoding
+			if encoding == "" && tt.name != "uncompressed" {
+				encoding = "gzip"
+			}
+			h, next := newTestHandler(t, &tt.config)
+			body := io.NopCloser(bytes.NewReader(encoded))
+			r := httptest.NewRequest(http.MethodPost, "/upload", body)
+			r.ContentLength = int64(len(encoded))
+			if encoding != "" {
+				r.Header.Set("Content-Encoding", encoding)
+			}
+			if tt.prepare != nil {
+				tt.prepare(r)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			rec := next.last()
+			if rec.request == nil {
+				t.Fatal("next handler not called")
+			}
+			if rec.request.Body != body {
+				t.Error("next handler got a replaced body")
+			}
+			if !bytes.Equal(rec.body, encoded) {
+				t.Errorf("next handler got %q, want %q", rec.body, encoded)
+			}
+			if got := rec.header.Get("Content-Encoding"); got != encoding {
+				t.Errorf("got Content-Encoding %q, want %q", got, encoding)
+			}
+		})
+	}
+}
+
+// TestUpgradePassthrough checks that a WebSocket handshake is passed
+// through exactly as the client sent it, whatever its Content-Encoding and
+// the options that would otherwise rewrite it, and isn't counted; and that
+// only a Connection header that lists upgrade next to an Upgrade header
+// makes a request an upgrade.
+func TestUpgradePassthrough(t *testing.T) {
+	encoded := encodeSample(t, "gzip", samplePlain)
+	tests := []struct {
+		name        string
+		connection  string
+		upgrade     string
+		wantUpgrade bool
+	}{
+		{"websocket", "Upgrade", "websocket", true},
+		{"listed", "keep-alive, upgrade", "websocket", true},
+		{"no Upgrade header", "Upgrade", "", false},
+		{"not in Connection", "keep-alive", "websocket", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Middleware{
+				Sniff:                  true,
+				PreserveEncodingHeader: "X-Original-Encoding",
+				SignalHeader:           "X-Request-Decompressed",
+			}
+			h, next := newTestHandler(t, m)
+			body := io.NopCloser(bytes.NewReader(encoded))
+			r := httptest.NewRequest(http.MethodGet, "/socket", body)
+			r.ContentLength = int64(len(encoded))
+			r.Header.Set("Content-Encoding", "gzip")
+			r.Header.Set("Connection", tt.connection)
+			if tt.upgrade != "" {
+				r.Header.Set("Upgrade", tt.upgrade)
+			}
+			r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			r.Header.Set("Sec-WebSocket-Version", "13")
+			sent := r.Header.Clone()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			rec := next.last()
+			if !tt.wantUpgrade {
+				if !bytes.Equal(rec.body, samplePlain) {
+					t.Errorf("got body %q, want it decoded to %q", rec.body, samplePlain)
+				}
+				return
+			}
+			if rec.request.Body != body || !bytes.Equal(rec.body, encoded) {
+				t.Errorf("got body %q, want the one sent, unread", rec.body)
+			}
+			if !reflect.DeepEqual(rec.header, sent) || rec.contentLength != int64(len(encoded)) {
+				t.Errorf("got headers %v and Content-Length %d, want %v and %d", rec.header, rec.contentLength, sent, len(encoded))
+			}
+			if got := w.Header().Get(m.SignalHeader); got != "" {
+				t.Errorf("got %s %q, want none", m.SignalHeader, got)
+			}
+			if s := snapshot(m); s.TotalRequests != 0 || s.UncompressedRequests != 0 {
+				t.Errorf("got %d requests and %d uncompressed, want none", s.TotalRequests, s.UncompressedRequests)
+			}
+		})
+	}
+}
+
+// TestConcurrentRequests sends valid and invalid bodies in several
+// encodings from many goroutines at once through one handler, whose pooled
+// decoders and metrics they share. Run it with -race.
+func TestConcurrentRequests(t *testing.T) {
+	var encodings []string
+	for _, encoding := range []string{"gzip", "deflate", "zstd", "lz4", "snappy"} {
+		if decoderFactories[encoding] != nil {
+			encodings = append(encodings, encoding)
+		}
+	}
+	bodies := make(map[string][]byte)
+	for _, encoding := range encodings {
+		bodies[encoding] = encodeSample(t, encoding, samplePlain)
+	}
+
+	m := &Middleware{}
+	h, next := newTestHandler(t, m)
+	const perEncoding = 50
+	var wg sync.WaitGroup
+	for _, encoding := range encodings {
+		for i := range perEncoding {
+			wg.Go(func() {
+				body, want := bodies[encoding], http.StatusOK
+				if i%5 == 0 {
+					body, want = body[:len(body)/2], http.StatusBadRequest
+				}
+				if w := postBody(h, encoding, bytes.NewReader(body)); w.Code != want {
+					t.Errorf("%s: got status %d, want %d", encoding, w.Code, want)
+				}
+			})
+		}
+	}
+	wg.Wait()
+
+	for _, rec := range next.requests {
+		if !bytes.Equal(rec.body, samplePlain) {
+			t.Errorf("next handler got body %q, want %q", rec.body, samplePlain)
+		}
+	}
+	s := snapshot(m)
+	total := int64(len(encodings) * perEncoding)
+	if s.TotalRequests != total || s.FailedRequests != total/5 || s.SuccessfulRequests != total-total/5 {
+		t.Errorf("got %d requests, %d failed and %d successful, want %d, %d and %d",
+			s.TotalRequests, s.FailedRequests, s.SuccessfulRequests, total, total/5, total-total/5)
+	}
+	for _, encoding := range encodings {
+		if got := s.RequestsByEncoding[encoding]; got != perEncoding {
+			t.Errorf("got %d %s requests, want %d", got, encoding, perEncoding)
+		}
+	}
+}
+
+// benchSizes are the decompressed body sizes benchmarks run with.
+var benchSizes = []struct {
+	name string
+	size int
+}{
+	{"small", 1 << 10},
+	{"medium", 64 << 10},
+	{"large", 4 << 20},
+}
+
+// BenchmarkServeHTTP decodes bodies of each size in each codec the tests
+// can encode at any size, through ServeHTTP with the default config.
+// Decoders are always pooled, so allocs/op guards the pooling.
+func BenchmarkServeHTTP(b *testing.B) {
+	for _, encoding := range builtinEncodings {
+		switch encoding {
+		case "identity", "bz2", "compress":
+			continue // nothing to decode, or no encoder for large bodies
+		}
+		for _, size := range benchSizes {
+			b.Run(encoding+"/"+size.name, func(b *testing.B) {
+				benchServe(b, &Middleware{}, encoding, benchPayload(size.size))
+			})
+		}
+	}
+}
+
+// BenchmarkBufferSize decodes large gzip bodies with buffer_size set to
+// each value.
+func BenchmarkBufferSize(b *testing.B) {
+	payload := benchPayload(4 << 20)
+	for _, size := range []int64{4 << 10, 32 << 10, 256 << 10} {
+		b.Run(strconv.FormatInt(size>>10, 10)+"KiB", func(b *testing.B) {
+			benchServe(b, &Middleware{BufferSize: size}, "gzip", payload)
+		})
+	}
+}
+
+// BenchmarkZstdConcurrency decodes large zstd bodies with
+// zstd_concurrency set to each value.
+func BenchmarkZstdConcurrency(b *testing.B) {
+	if decoderFactories["zstd"] == nil {
+		b.Skip("zstd is not built in")
+	}
+	payload := benchPayload(4 << 20)
+	for _, concurrency := range []int{1, 4} {
+		b.Run(strconv.Itoa(concurrency), func(b *testing.B) {
+			benchServe(b, &Middleware{ZstdConcurrency: concurrency}, "zstd", payload)
+		})
+	}
+}
+
+// BenchmarkStream decodes large gzip bodies buffered and streamed.
+func BenchmarkStream(b *testing.B) {
+	payload := benchPayload(4 << 20)
+	for _, stream := range []bool{false, true} {
+		b.Run("stream="+strconv.FormatBool(stream), func(b *testing.B) {
+			benchServe(b, &Middleware{Stream: stream}, "gzip", payload)
+		})
+	}
+}
+
+// benchServe measures serving payload encoded as encoding through m, to a
+// next handler that reads and discards the body.
+func benchServe(b *testing.B, m *Middleware, encoding string, payload []byte) {
+	body := encodeSample(b, encoding, payload)
+	h := provisionTest(b, m).WithNext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
+			w.WriteHeader(errorStatus(err))
+		}
+	}))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for b.Loop() {
+		if w := postBody(h, encoding, bytes.NewReader(body)); w.Code != http.StatusOK {
+			b.Fatalf("got status %d", w.Code)
+		}
+	}
+}
+
+// benchPayload returns size bytes of JSON-RPC-like records, the same for
+// every run so that results can be compared, and about as compressible as
+// real API traffic.
+func benchPayload(size int) []byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	methods := []string{"eth_call", "eth_getBalance", "eth_getLogs", "eth_sendRawTransaction"}
+	var buf bytes.Buffer
+	for id := 1; buf.Len() < size; id++ {
+		fmt.Fprintf(&buf, `{"jsonrpc":"2.0","id":%d,"method":%q,"params":["0x%016x",%d]}`+"\n",
+			id, methods[rng.IntN(len(methods))], rng.Uint64(), rng.IntN(1<<20))
+	}
+	return buf.Bytes()[:size]
+}
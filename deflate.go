@@ -0,0 +1,85 @@
+//go:build !minimal && !nodeflate
+
+package request_decompressor
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+func init() {
+	registerDecoder("deflate", newDeflateDecoder)
+	registerEncoder("deflate", func(dst io.Writer) (io.WriteCloser, error) {
+		return zlib.NewWriter(dst), nil
+	})
+}
+
+// newDeflateDecoder sets up deflate decoding for m, with the preset
+// dictionary in DeflateDict if there is one.
+func newDeflateDecoder(m *Middleware) (decodeFunc, error) {
+	if m.DeflateDict == "" {
+		return decodeDeflate, nil
+	}
+	dict, err := os.ReadFile(m.DeflateDict)
+	if err != nil {
+		return nil, fmt.Errorf("loading deflate dictionary: %v", err)
+	}
+	return func(src io.Reader) (io.ReadCloser, error) {
+		return decodeDeflateDict(src, dict)
+	}, nil
+}
+
+// decodeDeflate decodes a "deflate" body. It is supposed to be
+// zlib-wrapped, but plenty of clients send raw DEFLATE, so it falls back
+// to that if there's no zlib header.
+func decodeDeflate(src io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(src)
+	if header, err := buffered.Peek(2); err == nil && isZlibHeader(header) {
+		return zlib.NewReader(buffered)
+	}
+	return &rawDeflateReader{ReadCloser: flate.NewReader(buffered)}, nil
+}
+
+// decodeDeflateDict is decodeDeflate with a preset dictionary. zlib
+// streams that name a dictionary (FDICT) must name this one, or decoding
+// fails with zlib.ErrDictionary; raw DEFLATE carries no checksum, so the
+// dictionary is always available to it.
+func decodeDeflateDict(src io.Reader, dict []byte) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(src)
+	if header, err := buffered.Peek(2); err == nil && isZlibHeader(header) {
+		return zlib.NewReaderDict(buffered, dict)
+	}
+	return &rawDeflateReader{ReadCloser: flate.NewReaderDict(buffered, dict)}, nil
+}
+
+// rawDeflateReader reports corrupt input before any output as a malformed
+// header. Raw DEFLATE has no header to check up front, and a body that
+// doesn't decode even its first block most likely isn't DEFLATE at all.
+type rawDeflateReader struct {
+	io.ReadCloser
+	started bool
+}
+
+// Read implements io.Reader.
+func (d *rawDeflateReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if n > 0 {
+		d.started = true
+	}
+	var corrupt flate.CorruptInputError
+	if !d.started && errors.As(err, &corrupt) {
+		err = headerError(err)
+	}
+	return n, err
+}
+
+// isZlibHeader reports whether header starts a zlib stream (RFC 1950):
+// the compression method is DEFLATE and the check bits are valid.
+func isZlibHeader(header []byte) bool {
+	return header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
@@ -0,0 +1,290 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// grpcHeaderSize is the size of the prefix in front of every gRPC message:
+// a flags byte followed by the big-endian message length.
+const grpcHeaderSize = 5
+
+// grpcFlagCompressed marks a message compressed with the grpc-encoding.
+const grpcFlagCompressed = 0x01
+
+// defaultGRPCLimit bounds how much of a gRPC body is held in memory when
+// neither MaxDecompressedSize nor MaxCompressedSize does: each message as
+// it is decoded, or the whole body with InspectOnly. It is the largest
+// message gRPC servers accept by default.
+const defaultGRPCLimit = 4 << 20
+
+// serveGRPC decompresses the individually compressed messages of a gRPC-Web
+// or gRPC request body. Each message is length-prefixed, and only those
+// flagged as compressed are decoded; the body is rewritten with every
+// message uncompressed and the grpc-encoding header removed. Messages are
+// decoded one at a time as the next handler reads the body, so client- and
+// bidi-streaming calls keep working, and only the message being rewritten
+// is held in memory.
+func (m *Middleware) serveGRPC(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, encoding string) error {
+	encodings := []string{encoding}
+	if m.SampleRate > 0 && rand.Float64() >= m.SampleRate {
+		return next.ServeHTTP(w, r)
+	}
+	m.metrics.requestStarted(encodings)
+
+	if m.Observe {
+		m.logger.Info("would decompress gRPC messages",
+			zap.String("encoding", encoding),
+			zap.Int64("compressed_size", r.ContentLength),
+			zap.Bool("supported", m.canDecode(encoding)),
+		)
+		m.metrics.requestPassedThrough(encodings)
+		return next.ServeHTTP(w, r)
+	}
+
+	if !m.canDecode(encoding) {
+		if m.OnUnsupported == unsupportedPassthrough {
+			m.metrics.requestPassedThrough(encodings)
+			return next.ServeHTTP(w, r)
+		}
+		return m.fail(w, r, encodings, http.StatusBadRequest, unsupportedEncodingError(encoding))
+	}
+
+	if m.limiters != nil && !m.limiters.allow(m.clientIP(r)) {
+		err := withReason(reasonRateLimited, errors.New("too many decompressions from this client"))
+		return m.fail(w, r, encodings, http.StatusTooManyRequests, err)
+	}
+
+	// The messages are decoded while the next handler reads them, so the
+	// slot is held until that handler returns.
+	releaseSlot := func() {}
+	if m.slots != nil {
+		if !m.acquireSlot(r) {
+			err := withReason(reasonBusy, errors.New("too many concurrent decompressions"))
+			return m.fail(w, r, encodings, http.StatusServiceUnavailable, err)
+		}
+		releaseSlot = sync.OnceFunc(func() { <-m.slots })
+		defer releaseSlot()
+	}
+
+	start := time.Now()
+	span := startDecodeSpan(r.Context(), encodings)
+	ctx, cancel := m.decodeContext(w, r)
+	defer cancel()
+	var src io.Reader = r.Body
+	var raw bytes.Buffer
+	if m.InspectOnly {
+		src = io.TeeReader(r.Body, &raw)
+	}
+	if m.DecompressTimeout > 0 {
+		src = &contextReader{ReadCloser: io.NopCloser(src), ctx: ctx}
+	}
+	compressed := &countingReader{Reader: src}
+	maxCompressedSize := m.MaxCompressedSize
+	if m.InspectOnly && maxCompressedSize == 0 {
+		maxCompressedSize = defaultGRPCLimit
+	}
+	if maxCompressedSize > 0 {
+		compressed.Reader = &compressedLimitedReader{Reader: src, limit: maxCompressedSize}
+	}
+	maxSize := m.maxSize(r)
+	if m.InspectOnly && maxSize == 0 {
+		maxSize = defaultGRPCLimit
+	}
+	messages := &grpcReader{
+		m:        m,
+		ctx:      ctx,
+		src:      compressed,
+		encoding: encoding,
+		maxSize:  maxSize,
+	}
+
+	var stats decodeStats
+	if !m.InspectOnly {
+		r.Body = &decompressReader{
+			ReadCloser: io.NopCloser(messages),
+			body:       r.Body,
+			stop:       cancel,
+			onDone: func(decompressedSize int64, err error) {
+				endDecodeSpan(span, compressed.n, decompressedSize, err)
+				if err != nil && clientAborted(ctx, r, compressed) {
+					m.decodeAborted(encodings, err)
+					return
+				}
+				if err != nil {
+					m.decodeFailed(encodings, err)
+					return
+				}
+				elapsed := time.Since(start)
+				m.decodeSucceeded(encodings, compressed.n, decompressedSize, elapsed)
+				stats.set(compressed.n, decompressedSize, elapsed)
+				setPlaceholders(r, encodings, decompressedSize)
+			},
+		}
+		r.Header.Del("Grpc-Encoding")
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		setVars(r, encodings)
+		m.setSignalHeader(w, encodings)
+		defer span.End()
+		return m.serveDecoded(w, r, next, &stats)
+	}
+
+	// The body placeholder needs all of the decoded body, so inspecting
+	// reads it ahead, within the limits above.
+	decompressed, err := io.ReadAll(messages)
+	aborted := err != nil && clientAborted(ctx, r, compressed)
+	cancel() // the timeout doesn't extend to the next handler
+	releaseSlot()
+	endDecodeSpan(span, compressed.n, int64(len(decompressed)), err)
+	if aborted {
+		m.decodeAborted(encodings, err)
+		return caddyhttp.Error(statusClientClosedRequest, err)
+	}
+	if err != nil {
+		return m.fail(w, r, encodings, m.decodeErrorStatus(err), err)
+	}
+
+	elapsed := time.Since(start)
+	m.decodeSucceeded(encodings, compressed.n, int64(len(decompressed)), elapsed)
+	stats.set(compressed.n, int64(len(decompressed)), elapsed)
+	setPlaceholders(r, encodings, int64(len(decompressed)))
+	setVars(r, encodings)
+	m.setSignalHeader(w, encodings)
+	setBodyPlaceholder(r, decompressed)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&raw, r.Body), r.Body}
+	return m.serveDecoded(w, r, next, &stats)
+}
+
+// grpcReader rewrites a body of length-prefixed gRPC messages as it is
+// read, decoding those flagged as compressed according to encoding. One
+// message is held at a time: its compressed length may be at most
+// MaxCompressedSize and its decoded length at most maxSize, or
+// defaultGRPCLimit where they are 0. maxSize also bounds the body as a
+// whole.
+type grpcReader struct {
+	m        *Middleware
+	ctx      context.Context
+	src      io.Reader
+	encoding string
+	maxSize  int64
+
+	pending []byte // rewritten bytes not yet read
+	written int64  // rewritten bytes so far
+	err     error
+}
+
+// Read implements io.Reader.
+func (g *grpcReader) Read(p []byte) (int, error) {
+	for len(g.pending) == 0 {
+		if g.err != nil {
+			return 0, g.err
+		}
+		g.err = g.next()
+	}
+	n := copy(p, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
+
+// next reads, and if need be decodes, the next message into pending. It
+// returns io.EOF at the end of a body that ends between messages.
+func (g *grpcReader) next() error {
+	var header [grpcHeaderSize]byte
+	if _, err := io.ReadFull(g.src, header[:]); err == io.EOF {
+		return io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return errors.New("truncated gRPC message header")
+	} else if err != nil {
+		return err
+	}
+	flags := header[0]
+	length := int64(binary.BigEndian.Uint32(header[1:]))
+
+	limit := g.m.MaxCompressedSize
+	if limit == 0 {
+		limit = defaultGRPCLimit
+	}
+	if length > limit {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			withReason(reasonCompressedSize, fmt.Errorf("gRPC message of %d bytes exceeds %d bytes", length, limit)))
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(g.src, message); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("gRPC message of %d bytes is cut short", length)
+	} else if err != nil {
+		return err
+	}
+
+	if flags&grpcFlagCompressed != 0 {
+		limit := g.maxSize
+		if limit == 0 {
+			limit = defaultGRPCLimit
+		} else {
+			limit = max(limit-g.written-grpcHeaderSize, 0)
+		}
+		var err error
+		if message, err = g.m.decodeGRPCMessage(g.ctx, g.encoding, message, limit); err != nil {
+			if failureReason(err) == reasonSizeLimit {
+				return g.sizeError()
+			}
+			return err
+		}
+	}
+
+	header[0] = flags &^ grpcFlagCompressed
+	binary.BigEndian.PutUint32(header[1:], uint32(len(message)))
+	g.written += grpcHeaderSize + int64(len(message))
+	if g.maxSize > 0 && g.written > g.maxSize {
+		return g.sizeError()
+	}
+	g.pending = append(header[:], message...)
+	return nil
+}
+
+// sizeError reports the body, or without maxSize the message, as having
+// decoded to too many bytes.
+func (g *grpcReader) sizeError() error {
+	err := fmt.Errorf("decompressed body exceeds %d bytes", g.maxSize)
+	if g.maxSize == 0 {
+		err = fmt.Errorf("decompressed gRPC message exceeds %d bytes", defaultGRPCLimit)
+	}
+	return caddyhttp.Error(http.StatusRequestEntityTooLarge, withReason(reasonSizeLimit, err))
+}
+
+// decodeGRPCMessage decodes a single message to at most limit bytes.
+// MaxRatio applies to the message on its own.
+func (m *Middleware) decodeGRPCMessage(ctx context.Context, encoding string, message []byte, limit int64) ([]byte, error) {
+	compressed := &countingReader{Reader: bytes.NewReader(message)}
+	decoder, err := m.newDecoder(encoding, compressed)
+	if err != nil {
+		return nil, headerError(err)
+	}
+	decoder = &sizeLimitedReader{ReadCloser: decoder, limit: limit}
+	if m.MaxRatio > 0 {
+		decoder = &ratioLimitedReader{ReadCloser: decoder, compressed: compressed, maxRatio: m.MaxRatio}
+	}
+	decoder = &contextReader{ReadCloser: decoder, ctx: ctx}
+	decoded, err := io.ReadAll(decoder)
+	if closeErr := decoder.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, streamError(err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,36 @@
+package request_decompressor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// WithNext returns a plain http.Handler that runs m in front of next, so
+// the middleware can be used and tested without a Caddy server. m must be
+// provisioned first. Requests get a fresh replacer if they don't carry one,
+// and errors are answered with their status code like Caddy's default
+// error handling does.
+func (m *Middleware) WithNext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); !ok {
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+		}
+		err := m.ServeHTTP(w, r, caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			next.ServeHTTP(w, r)
+			return nil
+		}))
+		if err == nil {
+			return
+		}
+		status := http.StatusInternalServerError
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+			status = handlerErr.StatusCode
+		}
+		w.WriteHeader(status)
+	})
+}
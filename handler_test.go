@@ -0,0 +1,187 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// newTestHandler provisions m and returns it in front of a recording next
+// handler, as a plain http.Handler. Tests describe their cases as the
+// Middleware config to run and check the recorder afterwards:
+//
+//	h, next := newTestHandler(t, &Middleware{MaxDecompressedSize: 1 << 20})
+//	w := postBody(h, "gzip", bytes.NewReader(body))
+//	if w.Code != http.StatusOK || !bytes.Equal(next.last().body, want) { ... }
+func newTestHandler(tb testing.TB, m *Middleware) (http.Handler, *recordingHandler) {
+	tb.Helper()
+	provisionTest(tb, m)
+	next := new(recordingHandler)
+	return m.WithNext(next), next
+}
+
+// provisionTest provisions m in a throwaway Caddy context that is
+// cancelled when the test ends, and silences its logs.
+func provisionTest(tb testing.TB, m *Middleware) *Middleware {
+	tb.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	tb.Cleanup(cancel)
+	if err := m.Provision(ctx); err != nil {
+		tb.Fatal(err)
+	}
+	// Every decoded body is logged at debug level, which would bury the
+	// output of benchmarks.
+	m.logger = zap.NewNop()
+	return m
+}
+
+// postBody sends body to h as a POST with the given Content-Encoding, or
+// none if encoding is empty, and returns the response.
+func postBody(h http.Handler, encoding string, body io.Reader) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", body)
+	if encoding != "" {
+		r.Header.Set("Content-Encoding", encoding)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// recordingHandler is a next handler that reads the whole body and records
+// what it was given. A body that fails to read is answered with the status
+// of its error, as a Caddy handler returning that error would be. It is
+// safe for concurrent requests.
+type recordingHandler struct {
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+// recordedRequest is a request as the next handler saw it.
+type recordedRequest struct {
+	request       *http.Request
+	header        http.Header
+	contentLength int64
+	body          []byte
+	err           error // from reading the body
+}
+
+// ServeHTTP implements http.Handler.
+func (h *recordingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := recordedRequest{
+		request:       r,
+		header:        r.Header.Clone(),
+		contentLength: r.ContentLength,
+	}
+	rec.body, rec.err = io.ReadAll(r.Body)
+	h.mu.Lock()
+	h.requests = append(h.requests, rec)
+	h.mu.Unlock()
+
+	if rec.err != nil {
+		w.WriteHeader(errorStatus(rec.err))
+	}
+}
+
+// calls returns how many requests reached the handler.
+func (h *recordingHandler) calls() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.requests)
+}
+
+// last returns the latest request to reach the handler, or the zero
+// recordedRequest if none has.
+func (h *recordingHandler) last() recordedRequest {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.requests) == 0 {
+		return recordedRequest{}
+	}
+	return h.requests[len(h.requests)-1]
+}
+
+// errorStatus returns the status Caddy answers err with.
+func errorStatus(err error) int {
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+		return handlerErr.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+// snapshot returns the current metrics of m.
+func snapshot(m *Middleware) metricsSnapshot {
+	s := metricsSnapshot{
+		RequestsByEncoding: make(map[string]int64),
+		SecondsByEncoding:  make(map[string]float64),
+		FailuresByReason:   make(map[string]int64),
+	}
+	m.metrics.addTo(&s)
+	return s
+}
+
+func TestWithNext(t *testing.T) {
+	plain := []byte(`{"hello":"world"}`)
+	tests := []struct {
+		name       string
+		config     Middleware
+		encoding   string
+		body       []byte
+		wantStatus int
+		wantBody   []byte
+		wantCalls  int
+	}{
+		{
+			name:       "decoded",
+			encoding:   "gzip",
+			body:       encodeSample(t, "gzip", plain),
+			wantStatus: http.StatusOK,
+			wantBody:   plain,
+			wantCalls:  1,
+		},
+		{
+			name:       "uncompressed",
+			body:       plain,
+			wantStatus: http.StatusOK,
+			wantBody:   plain,
+			wantCalls:  1,
+		},
+		{
+			name:       "error status",
+			encoding:   "gzip",
+			body:       plain,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "limit status",
+			config:     Middleware{MaxDecompressedSize: 5},
+			encoding:   "gzip",
+			body:       encodeSample(t, "gzip", plain),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, next := newTestHandler(t, &tt.config)
+			w := postBody(h, tt.encoding, bytes.NewReader(tt.body))
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := next.calls(); got != tt.wantCalls {
+				t.Fatalf("next handler called %d times, want %d", got, tt.wantCalls)
+			}
+			if tt.wantCalls > 0 && !bytes.Equal(next.last().body, tt.wantBody) {
+				t.Errorf("next handler got body %q, want %q", next.last().body, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package request_decompressor
+
+import "io"
+
+// jsonPrefixReader ends the decompressed body right after its first
+// complete top-level JSON value, so whatever follows is never decoded. It
+// only tracks nesting, strings and escapes, not whether the value is
+// valid JSON; bodies that never complete a value are read to the end.
+type jsonPrefixReader struct {
+	io.ReadCloser
+
+	depth    int
+	inString bool
+	escaped  bool
+	scalar   bool // in a top-level number or literal
+	done     bool
+
+	// cut is set if the body was ended before the decoder reported the
+	// end of the data, so that more may have followed.
+	cut bool
+}
+
+// Read implements io.Reader.
+func (j *jsonPrefixReader) Read(p []byte) (int, error) {
+	if j.done {
+		return 0, io.EOF
+	}
+	n, err := j.ReadCloser.Read(p)
+	for i, c := range p[:n] {
+		switch {
+		case j.inString:
+			switch {
+			case j.escaped:
+				j.escaped = false
+			case c == '\\':
+				j.escaped = true
+			case c == '"':
+				j.inString = false
+				if j.depth == 0 {
+					return j.end(i+1, n, err)
+				}
+			}
+		case j.scalar:
+			// A number or literal ends at the first byte that can't be
+			// part of it, which isn't part of the value either.
+			if !isJSONScalarByte(c) {
+				return j.end(i, n, err)
+			}
+		case c == '"':
+			j.inString = true
+		case c == '{' || c == '[':
+			j.depth++
+		case c == '}' || c == ']':
+			j.depth--
+			if j.depth <= 0 {
+				return j.end(i+1, n, err)
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		default:
+			if j.depth == 0 {
+				j.scalar = true
+			}
+		}
+	}
+	return n, err
+}
+
+// end stops the body after the first end bytes of the n just read.
+func (j *jsonPrefixReader) end(end, n int, err error) (int, error) {
+	j.done = true
+	j.cut = end < n || err == nil
+	return end, io.EOF
+}
+
+func isJSONScalarByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c == '-' || c == '+' || c == '.'
+}
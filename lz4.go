@@ -0,0 +1,151 @@
+//go:build !minimal && !nolz4
+
+package request_decompressor
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+func init() {
+	registerDecoder("lz4", func(*Middleware) (decodeFunc, error) {
+		return func(src io.Reader) (io.ReadCloser, error) {
+			src, err := checkMagic(src, 4, func(magic []byte) bool {
+				switch m := binary.LittleEndian.Uint32(magic); {
+				case m == lz4FrameMagic, m == lz4LegacyMagic, m&0xfffffff0 == lz4SkippableMagic:
+					return true
+				}
+				return false
+			})
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(lz4.NewReader(newLZ4FrameChecker(src))), nil
+		}, nil
+	})
+	registerEncoder("lz4", func(dst io.Writer) (io.WriteCloser, error) {
+		return lz4.NewWriter(dst), nil
+	})
+}
+
+const (
+	lz4FrameMagic     = 0x184d2204
+	lz4LegacyMagic    = 0x184c2102
+	lz4SkippableMagic = 0x184d2a50 // low nibble is user-defined
+)
+
+// lz4 frame descriptor flags.
+const (
+	lz4FlagDictID          = 0x01
+	lz4FlagContentChecksum = 0x04
+	lz4FlagContentSize     = 0x08
+	lz4FlagBlockChecksum   = 0x10
+)
+
+type lz4State int
+
+const (
+	lz4StateMagic lz4State = iota
+	lz4StateSkippableSize
+	lz4StateDescriptor
+	lz4StateBlock
+	lz4StateUnchecked
+)
+
+// lz4FrameChecker passes an lz4 stream through unchanged while following
+// its frame structure. The lz4 reader treats a stream that stops on a block
+// boundary as complete, so this reports io.ErrUnexpectedEOF when the input
+// ends anywhere but between frames. Legacy and unrecognized frames are left
+// for the lz4 reader to judge.
+type lz4FrameChecker struct {
+	r     io.Reader
+	state lz4State
+	field []byte // bytes of the structural field being read
+	want  int    // length of that field
+	skip  int64  // opaque bytes to pass before the next field
+	flags byte   // descriptor flags of the current frame
+}
+
+func newLZ4FrameChecker(r io.Reader) *lz4FrameChecker {
+	return &lz4FrameChecker{r: r, want: 4}
+}
+
+// Read implements io.Reader.
+func (c *lz4FrameChecker) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.scan(p[:n])
+	if err == io.EOF && !c.complete() {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// complete reports whether the input seen so far ends between frames.
+func (c *lz4FrameChecker) complete() bool {
+	return c.state == lz4StateUnchecked ||
+		(c.state == lz4StateMagic && len(c.field) == 0 && c.skip == 0)
+}
+
+func (c *lz4FrameChecker) scan(data []byte) {
+	for len(data) > 0 && c.state != lz4StateUnchecked {
+		if c.skip > 0 {
+			n := min(int64(len(data)), c.skip)
+			c.skip -= n
+			data = data[n:]
+			continue
+		}
+		n := min(len(data), c.want-len(c.field))
+		c.field = append(c.field, data[:n]...)
+		data = data[n:]
+		if len(c.field) == c.want {
+			c.advance()
+			c.field = c.field[:0]
+		}
+	}
+}
+
+// advance moves to the next state once the current field is complete.
+func (c *lz4FrameChecker) advance() {
+	switch c.state {
+	case lz4StateMagic:
+		switch magic := binary.LittleEndian.Uint32(c.field); {
+		case magic == lz4FrameMagic:
+			c.state, c.want = lz4StateDescriptor, 2
+		case magic&0xfffffff0 == lz4SkippableMagic:
+			c.state, c.want = lz4StateSkippableSize, 4
+		default:
+			c.state = lz4StateUnchecked
+		}
+
+	case lz4StateSkippableSize:
+		c.skip = int64(binary.LittleEndian.Uint32(c.field))
+		c.state, c.want = lz4StateMagic, 4
+
+	case lz4StateDescriptor:
+		c.flags = c.field[0]
+		c.skip = 1 // header checksum
+		if c.flags&lz4FlagContentSize != 0 {
+			c.skip += 8
+		}
+		if c.flags&lz4FlagDictID != 0 {
+			c.skip += 4
+		}
+		c.state, c.want = lz4StateBlock, 4
+
+	case lz4StateBlock:
+		size := binary.LittleEndian.Uint32(c.field)
+		if size == 0 { // end mark
+			if c.flags&lz4FlagContentChecksum != 0 {
+				c.skip = 4
+			}
+			c.state, c.want = lz4StateMagic, 4
+			return
+		}
+		c.skip = int64(size & 0x7fffffff) // high bit flags an uncompressed block
+		if c.flags&lz4FlagBlockChecksum != 0 {
+			c.skip += 4
+		}
+	}
+}
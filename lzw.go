@@ -0,0 +1,222 @@
+//go:build !minimal && !nocompress
+
+package request_decompressor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+func init() {
+	registerDecoder("compress", func(*Middleware) (decodeFunc, error) {
+		return func(src io.Reader) (io.ReadCloser, error) {
+			zr, err := newLZWReader(src)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(zr), nil
+		}, nil
+	})
+}
+
+// Parameters of the Unix compress (.Z) format.
+const (
+	lzwFlagBlockMode = 0x80 // code 256 clears the table
+	lzwMaskMaxBits   = 0x1f
+	lzwInitBits      = 9
+	lzwMaxBits       = 16
+	lzwClear         = 256
+)
+
+var errLZWCorrupt = errors.New("compress: corrupt input")
+
+// lzwReader decodes the LZW variant written by the Unix compress utility.
+// compress/lzw can't read it: compress widens codes up to 16 bits, has no
+// end code, and discards the rest of the current group of eight codes
+// whenever the code width changes or the table is cleared.
+type lzwReader struct {
+	r          *bufio.Reader
+	maxBits    uint
+	blockMode  bool
+	nBits      uint
+	maxCode    int
+	maxMaxCode int
+	freeEnt    int
+	oldCode    int
+	finChar    byte
+
+	bits    uint32 // unread bits, least significant first
+	nBuf    uint   // number of unread bits in bits
+	runBits int    // bits read since the code width last changed
+
+	prefix []uint16
+	suffix []byte
+	stack  []byte
+	out    []byte
+	err    error
+}
+
+// newLZWReader reads the compress header from src and returns a reader
+// for the data that follows it.
+func newLZWReader(src io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(src)
+	var header [3]byte
+	if _, err := io.ReadFull(buffered, header[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if header[0] != 0x1f || header[1] != 0x9d {
+		return nil, errors.New("compress: invalid header")
+	}
+	maxBits := uint(header[2] & lzwMaskMaxBits)
+	if maxBits < lzwInitBits || maxBits > lzwMaxBits {
+		return nil, fmt.Errorf("compress: unsupported maximum code width of %d bits", maxBits)
+	}
+
+	z := &lzwReader{
+		r:          buffered,
+		maxBits:    maxBits,
+		blockMode:  header[2]&lzwFlagBlockMode != 0,
+		nBits:      lzwInitBits,
+		maxCode:    1<<lzwInitBits - 1,
+		maxMaxCode: 1 << maxBits,
+		oldCode:    -1,
+		prefix:     make([]uint16, 1<<maxBits),
+		suffix:     make([]byte, 1<<maxBits),
+	}
+	for i := range 256 {
+		z.suffix[i] = byte(i)
+	}
+	z.freeEnt = 256
+	if z.blockMode {
+		z.freeEnt = lzwClear + 1
+	}
+	return z, nil
+}
+
+// Read implements io.Reader.
+func (z *lzwReader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 && z.err == nil {
+		z.err = z.decode()
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	if len(z.out) == 0 && z.err != nil {
+		return n, z.err
+	}
+	return n, nil
+}
+
+// decode reads codes until one produces output.
+func (z *lzwReader) decode() error {
+	for {
+		if z.freeEnt > z.maxCode {
+			if err := z.skipGroup(); err != nil {
+				return err
+			}
+			z.nBits++
+			if z.nBits == z.maxBits {
+				z.maxCode = z.maxMaxCode
+			} else {
+				z.maxCode = 1<<z.nBits - 1
+			}
+		}
+
+		code, err := z.readCode()
+		if err != nil {
+			return err
+		}
+
+		if z.oldCode == -1 {
+			if code >= 256 {
+				return errLZWCorrupt
+			}
+			z.oldCode, z.finChar = code, byte(code)
+			z.out = append(z.out[:0], z.finChar)
+			return nil
+		}
+
+		if code == lzwClear && z.blockMode {
+			// The next code's entry lands on 256, which is never
+			// referenced, so the table restarts at 257.
+			z.freeEnt = lzwClear
+			if err := z.skipGroup(); err != nil {
+				return err
+			}
+			z.nBits = lzwInitBits
+			z.maxCode = 1<<lzwInitBits - 1
+			continue
+		}
+
+		inCode := code
+		z.stack = z.stack[:0]
+		if code >= z.freeEnt {
+			if code > z.freeEnt {
+				return errLZWCorrupt
+			}
+			z.stack = append(z.stack, z.finChar)
+			code = z.oldCode
+		}
+		for code >= 256 {
+			if len(z.stack) >= len(z.suffix) {
+				return errLZWCorrupt
+			}
+			z.stack = append(z.stack, z.suffix[code])
+			code = int(z.prefix[code])
+		}
+		z.finChar = byte(code)
+		z.stack = append(z.stack, z.finChar)
+
+		z.out = z.out[:0]
+		for i := len(z.stack) - 1; i >= 0; i-- {
+			z.out = append(z.out, z.stack[i])
+		}
+
+		if z.freeEnt < z.maxMaxCode {
+			z.prefix[z.freeEnt] = uint16(z.oldCode)
+			z.suffix[z.freeEnt] = z.finChar
+			z.freeEnt++
+		}
+		z.oldCode = inCode
+		return nil
+	}
+}
+
+// readCode reads the next code of the current width. It returns io.EOF
+// once fewer bits than that remain, as compress pads the last byte.
+func (z *lzwReader) readCode() (int, error) {
+	for z.nBuf < z.nBits {
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		z.bits |= uint32(b) << z.nBuf
+		z.nBuf += 8
+	}
+	code := int(z.bits & (1<<z.nBits - 1))
+	z.bits >>= z.nBits
+	z.nBuf -= z.nBits
+	z.runBits += int(z.nBits)
+	return code, nil
+}
+
+// skipGroup discards the rest of the current group of eight codes, which
+// compress leaves as padding before changing the code width.
+func (z *lzwReader) skipGroup() error {
+	groupBits := int(z.nBits) * 8
+	skip := (groupBits - z.runBits%groupBits) % groupBits
+	z.runBits = 0
+	if skip <= int(z.nBuf) {
+		z.bits >>= skip
+		z.nBuf -= uint(skip)
+		return nil
+	}
+	skip -= int(z.nBuf)
+	z.bits, z.nBuf = 0, 0
+	_, err := z.r.Discard(skip / 8)
+	return err
+}
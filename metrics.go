@@ -0,0 +1,420 @@
+package request_decompressor
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DecompressionMetrics tracks various metrics about decompression operations
+type DecompressionMetrics struct {
+	TotalRequests         int64
+	UncompressedRequests  int64
+	SuccessfulRequests    int64
+	FailedRequests        int64
+	ClientAbortedRequests int64
+	PassedThroughRequests int64
+	SniffedRequests       int64
+	CachedRequests        int64
+	GzipMembers           int64
+	CompressedBytes       int64
+	DecompressedBytes     int64
+	DecompressionTimings  float64
+	RequestsByCompression map[string]*int64
+	TimingsByCompression  map[string]float64
+	FailuresByReason      map[string]*int64
+
+	// mu guards the maps and DecompressionTimings; the other counters are
+	// updated atomically.
+	mu sync.RWMutex
+
+	prometheus *prometheusMetrics
+}
+
+// prometheusMetrics mirrors DecompressionMetrics into the Prometheus
+// registry of the Caddy config that provisioned the handler.
+type prometheusMetrics struct {
+	requests   *prometheus.CounterVec
+	successful *prometheus.CounterVec
+	failed     *prometheus.CounterVec
+	aborted    *prometheus.CounterVec
+	passed     *prometheus.CounterVec
+	failures   *prometheus.CounterVec
+
+	uncompressed prometheus.Counter
+	gzipMembers  prometheus.Counter
+
+	compressedBytes   *prometheus.CounterVec
+	decompressedBytes *prometheus.CounterVec
+
+	compressedSize   *prometheus.HistogramVec
+	decompressedSize *prometheus.HistogramVec
+	expansionRatio   *prometheus.HistogramVec
+	duration         *prometheus.HistogramVec
+}
+
+func newDecompressionMetrics(registry prometheus.Registerer) (*DecompressionMetrics, error) {
+	const ns, sub = "caddy", "request_decompress"
+	labels := []string{"encoding"}
+
+	var err error
+	pm := new(prometheusMetrics)
+	pm.requests, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "requests_total",
+		Help:      "Counter of compressed requests handled.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.successful, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "successful_requests_total",
+		Help:      "Counter of requests whose body was decompressed successfully.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.failed, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "failed_requests_total",
+		Help:      "Counter of requests whose body could not be decompressed.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.failures, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "failures_total",
+		Help:      "Counter of failed requests by the reason they failed.",
+	}, []string{"encoding", "reason"}))
+	if err != nil {
+		return nil, err
+	}
+	pm.aborted, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "client_aborted_requests_total",
+		Help:      "Counter of requests whose client went away before the body was received.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.passed, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "passed_through_requests_total",
+		Help:      "Counter of compressed requests forwarded without being decompressed.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.uncompressed, err = registerCollector(registry, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "uncompressed_requests_total",
+		Help:      "Counter of requests passed through because they had no Content-Encoding.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+	pm.gzipMembers, err = registerCollector(registry, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "gzip_members_total",
+		Help:      "Counter of gzip members decoded; above the gzip request count when bodies hold concatenated members.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	pm.compressedBytes, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "compressed_bytes_total",
+		Help:      "Counter of compressed request body bytes absorbed by successful decompressions.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.decompressedBytes, err = registerCollector(registry, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "decompressed_bytes_total",
+		Help:      "Counter of request body bytes produced by successful decompressions.",
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+
+	sizeBuckets := prometheus.ExponentialBuckets(256, 4, 10) // 256 B to 64 MiB
+	pm.compressedSize, err = registerCollector(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "compressed_size_bytes",
+		Help:      "Size of request bodies before decompression.",
+		Buckets:   sizeBuckets,
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.decompressedSize, err = registerCollector(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "decompressed_size_bytes",
+		Help:      "Size of request bodies after decompression.",
+		Buckets:   sizeBuckets,
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+	pm.expansionRatio, err = registerCollector(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "expansion_ratio",
+		Help:      "Ratio of decompressed to compressed request body size.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12), // 1x to 2048x
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+
+	pm.duration, err = registerCollector(registry, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "duration_seconds",
+		Help:      "Time spent decompressing request bodies.",
+		Buckets:   prometheus.DefBuckets,
+	}, labels))
+	if err != nil {
+		return nil, err
+	}
+
+	return &DecompressionMetrics{
+		RequestsByCompression: make(map[string]*int64),
+		TimingsByCompression:  make(map[string]float64),
+		FailuresByReason:      make(map[string]*int64),
+		prometheus:            pm,
+	}, nil
+}
+
+// registerCollector registers c with registry. If an identical collector
+// is already registered, e.g. by another request_decompress handler in the
+// same config, that one is returned instead so they share the series.
+func registerCollector[T prometheus.Collector](registry prometheus.Registerer, c T) (T, error) {
+	if err := registry.Register(c); err != nil {
+		var alreadyRegistered prometheus.AlreadyRegisteredError
+		if errors.As(err, &alreadyRegistered) {
+			if existing, ok := alreadyRegistered.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+// encodingLabel returns the value of the encoding label for a request
+// decoded with encodings. Only built-in encodings get their own label so
+// that clients can't inflate the number of series with made-up codings.
+func encodingLabel(encodings []string) string {
+	if len(encodings) > 1 {
+		return "chained"
+	}
+	if len(encodings) == 1 && slices.Contains(builtinEncodings, encodings[0]) {
+		return encodings[0]
+	}
+	return "other"
+}
+
+// requestStarted records a request whose body is about to be decoded.
+func (dm *DecompressionMetrics) requestStarted(encodings []string) {
+	atomic.AddInt64(&dm.TotalRequests, 1)
+	for _, encoding := range encodings {
+		dm.countEncoding(encoding)
+	}
+	dm.prometheus.requests.WithLabelValues(encodingLabel(encodings)).Inc()
+}
+
+// requestUncompressed records a request passed through because it had no
+// Content-Encoding.
+func (dm *DecompressionMetrics) requestUncompressed() {
+	atomic.AddInt64(&dm.UncompressedRequests, 1)
+	dm.prometheus.uncompressed.Inc()
+}
+
+// requestSucceeded records a request whose body was decoded.
+func (dm *DecompressionMetrics) requestSucceeded(encodings []string) {
+	atomic.AddInt64(&dm.SuccessfulRequests, 1)
+	dm.prometheus.successful.WithLabelValues(encodingLabel(encodings)).Inc()
+}
+
+// recordSizes records the size of a successfully decoded body before and
+// after decompression.
+func (dm *DecompressionMetrics) recordSizes(encodings []string, compressed, decompressed int64) {
+	atomic.AddInt64(&dm.CompressedBytes, compressed)
+	atomic.AddInt64(&dm.DecompressedBytes, decompressed)
+
+	label := encodingLabel(encodings)
+	dm.prometheus.compressedBytes.WithLabelValues(label).Add(float64(compressed))
+	dm.prometheus.decompressedBytes.WithLabelValues(label).Add(float64(decompressed))
+	dm.prometheus.compressedSize.WithLabelValues(label).Observe(float64(compressed))
+	dm.prometheus.decompressedSize.WithLabelValues(label).Observe(float64(decompressed))
+	if compressed > 0 {
+		dm.prometheus.expansionRatio.WithLabelValues(label).Observe(float64(decompressed) / float64(compressed))
+	}
+}
+
+// recordDuration records the time spent decoding a body. Timings are kept
+// per chain of encodings, e.g. "gzip" or "gzip, zstd".
+func (dm *DecompressionMetrics) recordDuration(encodings []string, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	key := strings.Join(encodings, ", ")
+
+	dm.mu.Lock()
+	dm.DecompressionTimings += seconds
+	dm.TimingsByCompression[key] += seconds
+	dm.mu.Unlock()
+
+	dm.prometheus.duration.WithLabelValues(encodingLabel(encodings)).Observe(seconds)
+}
+
+// requestFailed records a request whose body could not be decoded.
+func (dm *DecompressionMetrics) requestFailed(encodings []string, reason string) {
+	atomic.AddInt64(&dm.FailedRequests, 1)
+	atomic.AddInt64(counterFor(&dm.mu, dm.FailuresByReason, reason), 1)
+
+	label := encodingLabel(encodings)
+	dm.prometheus.failed.WithLabelValues(label).Inc()
+	dm.prometheus.failures.WithLabelValues(label, reason).Inc()
+}
+
+// requestAborted records a request whose client went away before its body
+// was fully received.
+func (dm *DecompressionMetrics) requestAborted(encodings []string) {
+	atomic.AddInt64(&dm.ClientAbortedRequests, 1)
+	dm.prometheus.aborted.WithLabelValues(encodingLabel(encodings)).Inc()
+}
+
+// requestPassedThrough records a request forwarded still compressed, e.g.
+// because on_unsupported passes its encoding through.
+func (dm *DecompressionMetrics) requestPassedThrough(encodings []string) {
+	atomic.AddInt64(&dm.PassedThroughRequests, 1)
+	dm.prometheus.passed.WithLabelValues(encodingLabel(encodings)).Inc()
+}
+
+// recordGzipMembers records the number of gzip members in a body.
+func (dm *DecompressionMetrics) recordGzipMembers(members int) {
+	atomic.AddInt64(&dm.GzipMembers, int64(members))
+	dm.prometheus.gzipMembers.Add(float64(members))
+}
+
+// countEncoding increments the request counter for encoding, creating it
+// on first use. Encodings that aren't built in share the "other" counter,
+// so that clients can't grow the map with made-up tokens.
+func (dm *DecompressionMetrics) countEncoding(encoding string) {
+	label := encodingLabel([]string{encoding})
+	atomic.AddInt64(counterFor(&dm.mu, dm.RequestsByCompression, label), 1)
+}
+
+// counterFor returns the counter for key in counters, which mu guards,
+// creating it on first use.
+func counterFor(mu *sync.RWMutex, counters map[string]*int64, key string) *int64 {
+	mu.RLock()
+	counter, exists := counters[key]
+	mu.RUnlock()
+
+	if !exists {
+		mu.Lock()
+		if counter, exists = counters[key]; !exists {
+			counter = new(int64)
+			counters[key] = counter
+		}
+		mu.Unlock()
+	}
+	return counter
+}
+
+// metricsSnapshot is a point-in-time copy of DecompressionMetrics, as
+// served by the admin API.
+type metricsSnapshot struct {
+	TotalRequests         int64              `json:"total_requests"`
+	UncompressedRequests  int64              `json:"uncompressed_requests"`
+	SuccessfulRequests    int64              `json:"successful_requests"`
+	FailedRequests        int64              `json:"failed_requests"`
+	ClientAbortedRequests int64              `json:"client_aborted_requests"`
+	PassedThroughRequests int64              `json:"passed_through_requests"`
+	SniffedRequests       int64              `json:"sniffed_requests"`
+	CachedRequests        int64              `json:"cached_requests"`
+	GzipMembers           int64              `json:"gzip_members"`
+	CompressedBytes       int64              `json:"compressed_bytes"`
+	DecompressedBytes     int64              `json:"decompressed_bytes"`
+	DecompressionSeconds  float64            `json:"decompression_seconds"`
+	RequestsByEncoding    map[string]int64   `json:"requests_by_encoding"`
+	SecondsByEncoding     map[string]float64 `json:"seconds_by_encoding"`
+	FailuresByReason      map[string]int64   `json:"failures_by_reason"`
+}
+
+// addTo adds the current values of dm to s.
+func (dm *DecompressionMetrics) addTo(s *metricsSnapshot) {
+	s.TotalRequests += atomic.LoadInt64(&dm.TotalRequests)
+	s.UncompressedRequests += atomic.LoadInt64(&dm.UncompressedRequests)
+	s.SuccessfulRequests += atomic.LoadInt64(&dm.SuccessfulRequests)
+	s.FailedRequests += atomic.LoadInt64(&dm.FailedRequests)
+	s.ClientAbortedRequests += atomic.LoadInt64(&dm.ClientAbortedRequests)
+	s.PassedThroughRequests += atomic.LoadInt64(&dm.PassedThroughRequests)
+	s.SniffedRequests += atomic.LoadInt64(&dm.SniffedRequests)
+	s.CachedRequests += atomic.LoadInt64(&dm.CachedRequests)
+	s.GzipMembers += atomic.LoadInt64(&dm.GzipMembers)
+	s.CompressedBytes += atomic.LoadInt64(&dm.CompressedBytes)
+	s.DecompressedBytes += atomic.LoadInt64(&dm.DecompressedBytes)
+
+	dm.mu.RLock()
+	defer dm.mu.RUnlock()
+	s.DecompressionSeconds += dm.DecompressionTimings
+	for encoding, counter := range dm.RequestsByCompression {
+		s.RequestsByEncoding[encoding] += atomic.LoadInt64(counter)
+	}
+	for key, seconds := range dm.TimingsByCompression {
+		s.SecondsByEncoding[key] += seconds
+	}
+	for reason, counter := range dm.FailuresByReason {
+		s.FailuresByReason[reason] += atomic.LoadInt64(counter)
+	}
+}
+
+// reset zeroes the counters of dm. The Prometheus series are left alone,
+// as counters there must never go down.
+func (dm *DecompressionMetrics) reset() {
+	atomic.StoreInt64(&dm.TotalRequests, 0)
+	atomic.StoreInt64(&dm.UncompressedRequests, 0)
+	atomic.StoreInt64(&dm.SuccessfulRequests, 0)
+	atomic.StoreInt64(&dm.FailedRequests, 0)
+	atomic.StoreInt64(&dm.ClientAbortedRequests, 0)
+	atomic.StoreInt64(&dm.PassedThroughRequests, 0)
+	atomic.StoreInt64(&dm.SniffedRequests, 0)
+	atomic.StoreInt64(&dm.CachedRequests, 0)
+	atomic.StoreInt64(&dm.GzipMembers, 0)
+	atomic.StoreInt64(&dm.CompressedBytes, 0)
+	atomic.StoreInt64(&dm.DecompressedBytes, 0)
+
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+	dm.DecompressionTimings = 0
+	for _, counter := range dm.RequestsByCompression {
+		atomic.StoreInt64(counter, 0)
+	}
+	for _, counter := range dm.FailuresByReason {
+		atomic.StoreInt64(counter, 0)
+	}
+	clear(dm.TimingsByCompression)
+}
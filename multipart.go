@@ -0,0 +1,410 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultMultipartLimit bounds how much of a multipart body is read ahead
+// where MaxCompressedSize doesn't: the plain parts in front of the first
+// encoded one, or with InspectOnly the whole body. With InspectOnly it also
+// bounds the decoded body where MaxDecompressedSize doesn't.
+const defaultMultipartLimit = 4 << 20
+
+// multipartChunkSize is how much of a part is rewritten at a time.
+const multipartChunkSize = 32 << 10
+
+// multipartBoundary returns the boundary of a multipart request body, or
+// "" if r doesn't have one.
+func multipartBoundary(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// serveMultipart decompresses the parts of a multipart request body that
+// carry a Content-Encoding header of their own. The body is rewritten with
+// the same boundary, those parts decoded and their Content-Encoding header
+// removed, and every other part copied as it is. Only the plain parts in
+// front of the first encoded one are read ahead; from there on, the body
+// is rewritten as the next handler reads it. Bodies without an encoded
+// part within the read-ahead limit, or that don't parse as multipart, are
+// forwarded untouched.
+func (m *Middleware) serveMultipart(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, boundary string) error {
+	start := time.Now()
+	ctx, cancel := m.decodeContext(w, r)
+	defer cancel()
+	// Whatever is read ahead is kept, so the body can be forwarded as it
+	// came if it turns out not to need decoding.
+	raw := &aheadBuffer{}
+	var src io.Reader = io.TeeReader(r.Body, raw)
+	if m.DecompressTimeout > 0 {
+		src = &contextReader{ReadCloser: io.NopCloser(src), ctx: ctx}
+	}
+	compressed := &countingReader{Reader: src}
+	aheadLimit := m.MaxCompressedSize
+	if aheadLimit == 0 {
+		aheadLimit = defaultMultipartLimit
+	}
+	if m.MaxCompressedSize > 0 || m.InspectOnly {
+		compressed.Reader = &compressedLimitedReader{Reader: src, limit: aheadLimit}
+	}
+	original := func() {
+		cancel() // nothing is read under the timeout from here on
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&raw.buf, r.Body), r.Body}
+	}
+
+	maxSize := m.maxSize(r)
+	if m.InspectOnly && maxSize == 0 {
+		maxSize = defaultMultipartLimit
+	}
+	parts := &multipartRewriter{
+		m:       m,
+		ctx:     ctx,
+		reader:  multipart.NewReader(compressed, boundary),
+		maxSize: maxSize,
+	}
+	parts.writer = multipart.NewWriter(&parts.out)
+	if err := parts.writer.SetBoundary(boundary); err != nil {
+		original()
+		m.metrics.requestUncompressed()
+		return next.ServeHTTP(w, r)
+	}
+
+	// Until an encoded part turns up, the body isn't known to be
+	// compressed, so failing to read it isn't counted as a failed decode.
+	found, err := parts.peek(aheadLimit)
+	if err != nil && compressed.err != nil {
+		if clientAborted(ctx, r, compressed) {
+			return caddyhttp.Error(statusClientClosedRequest, err)
+		}
+		return caddyhttp.Error(m.decodeErrorStatus(err), err)
+	}
+	if err != nil || !found {
+		original()
+		m.metrics.requestUncompressed()
+		return next.ServeHTTP(w, r)
+	}
+	encodings := slices.Clone(parts.encodings)
+	m.metrics.requestStarted(encodings)
+
+	if m.Observe {
+		m.logger.Info("would decompress multipart parts",
+			zap.String("encoding", strings.Join(encodings, ", ")),
+			zap.Int64("compressed_size", r.ContentLength),
+			zap.Bool("supported", !slices.ContainsFunc(encodings, func(encoding string) bool {
+				return !m.canDecode(encoding)
+			})),
+		)
+		original()
+		m.metrics.requestPassedThrough(encodings)
+		return next.ServeHTTP(w, r)
+	}
+
+	for _, encoding := range encodings {
+		if !m.canDecode(encoding) {
+			if m.OnUnsupported == unsupportedPassthrough {
+				original()
+				m.metrics.requestPassedThrough(encodings)
+				return next.ServeHTTP(w, r)
+			}
+			return m.fail(w, r, encodings, http.StatusBadRequest, unsupportedEncodingError(encoding))
+		}
+	}
+
+	if m.limiters != nil && !m.limiters.allow(m.clientIP(r)) {
+		err := withReason(reasonRateLimited, errors.New("too many decompressions from this client"))
+		return m.fail(w, r, encodings, http.StatusTooManyRequests, err)
+	}
+
+	// The parts are decoded while the next handler reads them, so the
+	// slot is held until that handler returns.
+	releaseSlot := func() {}
+	if m.slots != nil {
+		if !m.acquireSlot(r) {
+			err := withReason(reasonBusy, errors.New("too many concurrent decompressions"))
+			return m.fail(w, r, encodings, http.StatusServiceUnavailable, err)
+		}
+		releaseSlot = sync.OnceFunc(func() { <-m.slots })
+		defer releaseSlot()
+	}
+
+	span := startDecodeSpan(r.Context(), encodings)
+	var stats decodeStats
+	if !m.InspectOnly {
+		// The raw body is only needed for forwarding it untouched, which
+		// is no longer an option.
+		raw.stop()
+		r.Body = &decompressReader{
+			ReadCloser: io.NopCloser(parts),
+			body:       r.Body,
+			stop:       cancel,
+			onDone: func(decompressedSize int64, err error) {
+				endDecodeSpan(span, compressed.n, decompressedSize, err)
+				if err != nil && clientAborted(ctx, r, compressed) {
+					m.decodeAborted(parts.encodings, err)
+					return
+				}
+				if err != nil {
+					m.decodeFailed(parts.encodings, err)
+					return
+				}
+				elapsed := time.Since(start)
+				m.decodeSucceeded(parts.encodings, compressed.n, decompressedSize, elapsed)
+				stats.set(compressed.n, decompressedSize, elapsed)
+				setPlaceholders(r, parts.encodings, decompressedSize)
+			},
+		}
+		r.Header.Del("Content-Length")
+		r.ContentLength = -1
+		setVars(r, encodings)
+		m.setSignalHeader(w, encodings)
+		defer span.End()
+		return m.serveDecoded(w, r, next, &stats)
+	}
+
+	// The body placeholder needs all of the decoded body, so inspecting
+	// reads it ahead, within the limits above.
+	decompressed, err := io.ReadAll(parts)
+	aborted := err != nil && clientAborted(ctx, r, compressed)
+	endDecodeSpan(span, compressed.n, int64(len(decompressed)), err)
+	releaseSlot()
+	if aborted {
+		m.decodeAborted(parts.encodings, err)
+		return caddyhttp.Error(statusClientClosedRequest, err)
+	}
+	if err != nil {
+		return m.fail(w, r, parts.encodings, m.decodeErrorStatus(err), err)
+	}
+
+	elapsed := time.Since(start)
+	m.decodeSucceeded(parts.encodings, compressed.n, int64(len(decompressed)), elapsed)
+	stats.set(compressed.n, int64(len(decompressed)), elapsed)
+	setPlaceholders(r, parts.encodings, int64(len(decompressed)))
+	setVars(r, parts.encodings)
+	m.setSignalHeader(w, parts.encodings)
+	setBodyPlaceholder(r, decompressed)
+	original()
+	return m.serveDecoded(w, r, next, &stats)
+}
+
+// aheadBuffer keeps the bytes written to it until stopped.
+type aheadBuffer struct {
+	buf     bytes.Buffer
+	stopped bool
+}
+
+// Write implements io.Writer.
+func (a *aheadBuffer) Write(p []byte) (int, error) {
+	if !a.stopped {
+		a.buf.Write(p)
+	}
+	return len(p), nil
+}
+
+// stop drops the bytes kept so far and keeps no more.
+func (a *aheadBuffer) stop() {
+	a.stopped = true
+	a.buf = bytes.Buffer{}
+}
+
+// multipartRewriter rewrites a multipart body as it is read, decoding the
+// parts that have a Content-Encoding and removing that header from them.
+// Parts are rewritten a chunk at a time, so only the chunk at hand is held
+// in memory. The rewritten body may be at most maxSize bytes, unless
+// maxSize is 0.
+type multipartRewriter struct {
+	m       *Middleware
+	ctx     context.Context
+	reader  *multipart.Reader
+	writer  *multipart.Writer
+	maxSize int64
+
+	// encodings lists those of all parts so far, each once, in the order
+	// first seen.
+	encodings []string
+
+	out     bytes.Buffer    // rewritten bytes not yet read
+	read    int64           // rewritten bytes already read
+	next    *multipart.Part // part found by peek, not yet started
+	part    io.Reader       // rest of the part being rewritten
+	decoder io.Closer       // decoder of part, if it is encoded
+	dst     io.Writer       // where part is rewritten to
+	err     error
+}
+
+// peek rewrites the plain parts in front of the first encoded one, and
+// reports whether there is one before the end of the body or more than
+// limit bytes have been rewritten.
+func (p *multipartRewriter) peek(limit int64) (bool, error) {
+	for int64(p.out.Len()) <= limit {
+		part, err := p.reader.NextRawPart()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if encodings := parseContentEncoding(part.Header.Get("Content-Encoding")); len(encodings) > 0 {
+			p.addEncodings(encodings)
+			p.next = part
+			return true, nil
+		}
+		dst, err := p.writer.CreatePart(part.Header)
+		if err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(dst, part, limit+1-int64(p.out.Len())); err != nil && err != io.EOF {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Read implements io.Reader.
+func (p *multipartRewriter) Read(b []byte) (int, error) {
+	for p.out.Len() == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		p.err = p.fill()
+		if p.err != nil && p.decoder != nil {
+			p.decoder.Close()
+			p.decoder = nil
+		}
+	}
+	n, _ := p.out.Read(b)
+	p.read += int64(n)
+	return n, nil
+}
+
+// fill rewrites the next chunk of the body into out. It returns io.EOF
+// once the closing boundary has been written.
+func (p *multipartRewriter) fill() error {
+	if p.part == nil {
+		part := p.next
+		p.next = nil
+		if part == nil {
+			var err error
+			if part, err = p.reader.NextRawPart(); err == io.EOF {
+				if err := p.writer.Close(); err != nil {
+					return err
+				}
+				return io.EOF
+			} else if err != nil {
+				return err
+			}
+		}
+		if err := p.startPart(part); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.CopyN(p.dst, p.part, multipartChunkSize)
+	if p.maxSize > 0 && p.read+int64(p.out.Len()) > p.maxSize {
+		return caddyhttp.Error(http.StatusRequestEntityTooLarge,
+			withReason(reasonSizeLimit, fmt.Errorf("decompressed body exceeds %d bytes", p.maxSize)))
+	}
+	if err == io.EOF {
+		p.part = nil
+		if p.decoder != nil {
+			err, p.decoder = p.decoder.Close(), nil
+			if err != nil {
+				return streamError(err)
+			}
+		}
+		return nil
+	}
+	if err != nil && p.decoder != nil {
+		return streamError(err)
+	}
+	return err
+}
+
+// startPart writes the header of part and sets it up to be rewritten,
+// decoded if it has a Content-Encoding.
+func (p *multipartRewriter) startPart(part *multipart.Part) error {
+	header := part.Header
+	p.part = part
+	if encodings := parseContentEncoding(header.Get("Content-Encoding")); len(encodings) > 0 {
+		decoder, err := p.decodePart(encodings, part)
+		if decoder != nil || err != nil {
+			p.addEncodings(encodings)
+		}
+		if err != nil {
+			return err
+		}
+		if decoder != nil {
+			p.part, p.decoder = decoder, decoder
+			header.Del("Content-Encoding")
+			header.Del("Content-Length")
+		}
+	}
+	dst, err := p.writer.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	p.dst = dst
+	return nil
+}
+
+// decodePart returns a decoder for the data of a part, or nil if the part
+// is to be left encoded because on_unsupported passes it through. MaxRatio
+// applies to the part on its own.
+func (p *multipartRewriter) decodePart(encodings []string, data io.Reader) (io.ReadCloser, error) {
+	m := p.m
+	if m.MaxEncodingLayers > 0 && len(encodings) > m.MaxEncodingLayers {
+		return nil, withReason(reasonTooManyLayers,
+			fmt.Errorf("part has %d encoding layers, more than the %d allowed", len(encodings), m.MaxEncodingLayers))
+	}
+	for _, encoding := range encodings {
+		if !m.canDecode(encoding) {
+			if m.OnUnsupported == unsupportedPassthrough {
+				return nil, nil
+			}
+			return nil, caddyhttp.Error(http.StatusBadRequest, unsupportedEncodingError(encoding))
+		}
+	}
+	compressed := &countingReader{Reader: data}
+	decoder, err := m.newDecoderChain(encodings, compressed)
+	if err != nil {
+		return nil, headerError(err)
+	}
+	if m.MaxRatio > 0 {
+		decoder = &ratioLimitedReader{ReadCloser: decoder, compressed: compressed, maxRatio: m.MaxRatio}
+	}
+	return &contextReader{ReadCloser: decoder, ctx: p.ctx}, nil
+}
+
+// addEncodings adds those of encodings not seen before to p.encodings.
+// Past the first encoded part, which counts as the request starting, each
+// new one is counted as it turns up.
+func (p *multipartRewriter) addEncodings(encodings []string) {
+	started := len(p.encodings) > 0
+	for _, encoding := range encodings {
+		if !slices.Contains(p.encodings, encoding) {
+			p.encodings = append(p.encodings, encoding)
+			if started {
+				p.m.metrics.countEncoding(encoding)
+			}
+		}
+	}
+}
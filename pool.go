@@ -0,0 +1,125 @@
+package request_decompressor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+var gzipReaderPool sync.Pool
+
+// gzipState is what gzipReaderPool holds: a gzip reader and the buffered
+// reader it reads the body through, which is kept so that the reader can be
+// reset onto each member without reading past it.
+type gzipState struct {
+	zr *gzip.Reader
+	br *bufio.Reader
+}
+
+// getGzipReader returns a reader for the gzip members in src, reusing
+// pooled state if available. Members are decoded one at a time so they can
+// be counted; unless multistream is set, only the first one is read.
+// Closing the reader returns its state to the pool.
+func getGzipReader(src io.Reader, multistream bool) (*pooledGzipReader, error) {
+	state, ok := gzipReaderPool.Get().(*gzipState)
+	if !ok {
+		state = &gzipState{br: bufio.NewReader(src)}
+	} else {
+		state.br.Reset(src)
+	}
+
+	var err error
+	if state.zr == nil {
+		state.zr, err = gzip.NewReader(state.br)
+	} else {
+		err = state.zr.Reset(state.br)
+	}
+	if err != nil {
+		state.br.Reset(nil)
+		gzipReaderPool.Put(state)
+		return nil, err
+	}
+	state.zr.Multistream(false)
+	return &pooledGzipReader{state: state, multistream: multistream, members: 1}, nil
+}
+
+type pooledGzipReader struct {
+	state       *gzipState
+	multistream bool
+	members     int
+
+	// onDone, if set, is called once with the number of members that
+	// were started, when the last one ends or the reader is closed.
+	onDone func(members int)
+}
+
+// Read implements io.Reader.
+func (p *pooledGzipReader) Read(b []byte) (int, error) {
+	for {
+		n, err := p.state.zr.Read(b)
+		if err != io.EOF || !p.multistream {
+			return n, err
+		}
+		// The member ended; move on to the next one, if the body has
+		// more. Reset reports io.EOF when it doesn't.
+		if err := p.state.zr.Reset(p.state.br); err != nil {
+			p.done()
+			return n, err
+		}
+		p.state.zr.Multistream(false)
+		p.members++
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close implements io.Closer.
+func (p *pooledGzipReader) Close() error {
+	if p.state == nil {
+		return nil
+	}
+	err := p.state.zr.Close()
+	p.state.br.Reset(nil)
+	gzipReaderPool.Put(p.state)
+	p.state = nil
+	p.done()
+	return err
+}
+
+func (p *pooledGzipReader) done() {
+	if p.onDone != nil {
+		p.onDone(p.members)
+		p.onDone = nil
+	}
+}
+
+// bufferedDecoder reads from a decoder through a pooled bufio.Reader, so
+// the decoder is asked for large chunks even when the consumer reads in
+// small ones. Closing it closes the decoder and returns the buffer.
+type bufferedDecoder struct {
+	*bufio.Reader
+	decoder io.ReadCloser
+	pool    *sync.Pool
+}
+
+// newBufferedDecoder wraps decoder with a reader from pool, which must
+// hold *bufio.Reader values.
+func newBufferedDecoder(decoder io.ReadCloser, pool *sync.Pool) *bufferedDecoder {
+	br := pool.Get().(*bufio.Reader)
+	br.Reset(decoder)
+	return &bufferedDecoder{Reader: br, decoder: decoder, pool: pool}
+}
+
+// Close implements io.Closer.
+func (b *bufferedDecoder) Close() error {
+	if b.Reader == nil {
+		return nil
+	}
+	err := b.decoder.Close()
+	b.Reader.Reset(nil)
+	b.pool.Put(b.Reader)
+	b.Reader = nil
+	return err
+}
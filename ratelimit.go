@@ -0,0 +1,165 @@
+package request_decompressor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTimeout is how long a client's limiter is kept after its last
+// decompression. A bucket left idle this long has refilled completely, so
+// dropping it changes nothing for the client.
+const limiterIdleTimeout = time.Minute
+
+// ipLimiters hands out a token bucket per client IP, dropping the buckets
+// of clients that have gone quiet so the map doesn't grow without bound.
+type ipLimiters struct {
+	rate  rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiter
+	lastSweep time.Time
+}
+
+type ipLimiter struct {
+	*rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiters(perSecond float64) *ipLimiters {
+	return &ipLimiters{
+		rate:     rate.Limit(perSecond),
+		burst:    max(1, int(perSecond)),
+		limiters: make(map[string]*ipLimiter),
+	}
+}
+
+// allow reports whether the client may start another decompression now,
+// taking a token from its bucket if so.
+func (l *ipLimiters) allow(ip string) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > limiterIdleTimeout {
+		for key, limiter := range l.limiters {
+			if now.Sub(limiter.lastSeen) > limiterIdleTimeout {
+				delete(l.limiters, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	limiter, ok := l.limiters[ip]
+	if !ok {
+		limiter = &ipLimiter{Limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.limiters[ip] = limiter
+	}
+	limiter.lastSeen = now
+	return limiter.AllowN(now, 1)
+}
+
+// clientIP returns the IP of the client that sent r. With TrustedProxies,
+// requests from one of them are attributed to the address they forwarded
+// for; otherwise Caddy determines it from X-Forwarded-For and similar
+// headers only for requests from the server's trusted proxies, and outside
+// of a Caddy server the connection's address is used.
+func (m *Middleware) clientIP(r *http.Request) string {
+	if len(m.trustedProxies) > 0 {
+		return m.forwardedClientIP(r)
+	}
+	if ip, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string); ok && ip != "" {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// forwardedClientIP walks X-Forwarded-For from the nearest hop back and
+// returns the first address that isn't a trusted proxy, so clients can't
+// pick their IP by sending the header themselves. A hop that isn't an IP
+// address ends the walk and is taken as the client as it is, rather than
+// lumping the request in with everything else from the proxy before it.
+// Without the header, X-Real-IP is used. Only requests that come from a
+// trusted proxy are looked into at all.
+func (m *Middleware) forwardedClientIP(r *http.Request) string {
+	remote := remoteHost(r)
+	addr, err := netip.ParseAddr(remote)
+	if err != nil || !m.isTrustedProxy(addr) {
+		return remote
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return strings.TrimSpace(hops[i])
+		}
+		client = hop.Unmap().String()
+		if !m.isTrustedProxy(hop) {
+			return client
+		}
+	}
+	if client != "" {
+		return client
+	}
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+	return remote
+}
+
+// isTrustedProxy reports whether addr is in one of the TrustedProxies
+// ranges.
+func (m *Middleware) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range m.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the IP of the connection r came in on.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseTrustedProxies parses TrustedProxies, which are CIDR ranges or
+// single addresses.
+func parseTrustedProxies(ranges []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(ranges))
+	for _, value := range ranges {
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("parsing trusted_proxies: %v", err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("parsing trusted_proxies: %v", err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
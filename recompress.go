@@ -0,0 +1,34 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// recompress encodes data with encoding.
+func recompress(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder, err := newEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encoder.Write(data); err != nil {
+		encoder.Close()
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newEncoder returns a writer that compresses to dst according to
+// encoding. The data is only complete once the writer is closed.
+func newEncoder(encoding string, dst io.Writer) (io.WriteCloser, error) {
+	encode, ok := encoders[encoding]
+	if !ok {
+		return nil, fmt.Errorf("cannot recompress to %s", encoding)
+	}
+	return encode(dst)
+}
@@ -0,0 +1,172 @@
+package request_decompressor
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// responseEncodingPreference lists, in order of preference, the recompress
+// encodings that browsers and HTTP clients know.
+var responseEncodingPreference = []string{"zstd", "gzip", "deflate"}
+
+// responseEncodings returns the encodings responses can be compressed with
+// in this build, in order of preference.
+func responseEncodings() []string {
+	var available []string
+	for _, encoding := range responseEncodingPreference {
+		if encoders[encoding] != nil {
+			available = append(available, encoding)
+		}
+	}
+	return available
+}
+
+// minResponseSize is the Content-Length below which responses are sent
+// uncompressed, as compressing them would barely save anything.
+const minResponseSize = 512
+
+// compressResponseWriter compresses the response with encoding if the
+// response turns out to be eligible once its header is written. With an
+// empty encoding nothing is compressed, but eligible responses still get
+// a Vary header, since another client could have been sent a compressed
+// one.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	method      string
+	encoding    string
+	encoder     io.WriteCloser
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (cw *compressResponseWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	// Informational responses come before the real one.
+	if status < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+
+	if cw.eligible(status) {
+		header := cw.Header()
+		varyAcceptEncoding(header)
+		if cw.encoding != "" {
+			encoder, err := newEncoder(cw.encoding, cw.ResponseWriter)
+			if err == nil {
+				cw.encoder = encoder
+				header.Set("Content-Encoding", cw.encoding)
+				header.Del("Content-Length")
+				// The compressed representation is no longer byte for byte
+				// what a strong validator promises.
+				if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+					header.Set("ETag", "W/"+etag)
+				}
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// eligible reports whether a response with status and the header set so
+// far may be compressed.
+func (cw *compressResponseWriter) eligible(status int) bool {
+	header := cw.Header()
+	if cw.method == http.MethodHead || status == http.StatusNoContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length < minResponseSize {
+		return false
+	}
+	return true
+}
+
+// Write implements http.ResponseWriter.
+func (cw *compressResponseWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher, sending whatever has been compressed so
+// far to the client. Flushing before anything is written sends the header
+// of a 200 response, so the encoding is decided, and announced, first.
+func (cw *compressResponseWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController.
+func (cw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Close finishes the compressed stream, if the response was compressed.
+func (cw *compressResponseWriter) Close() error {
+	if cw.encoder == nil {
+		return nil
+	}
+	return cw.encoder.Close()
+}
+
+// varyAcceptEncoding adds Accept-Encoding to the Vary header unless it is
+// already listed there.
+func varyAcceptEncoding(header http.Header) {
+	if !slices.Contains(header.Values("Vary"), "Accept-Encoding") {
+		header.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// negotiateEncoding returns the encoding from offered, which is in order
+// of preference, that the Accept-Encoding header value ranks highest, or
+// "" if it accepts none of them.
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, ok := parseEncoding(part)
+		if !ok {
+			continue
+		}
+		_, params, _ := strings.Cut(part, ";")
+		weight := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					weight = q
+				}
+			}
+		}
+		weights[coding] = weight
+	}
+
+	var best string
+	var bestWeight float64
+	for _, encoding := range offered {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
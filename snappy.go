@@ -0,0 +1,32 @@
+//go:build !minimal && !nosnappy
+
+package request_decompressor
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+func init() {
+	registerDecoder("snappy", func(*Middleware) (decodeFunc, error) {
+		return decodeSnappy, nil
+	})
+	registerEncoder("snappy", func(dst io.Writer) (io.WriteCloser, error) {
+		return snappy.NewBufferedWriter(dst), nil
+	})
+}
+
+// decodeSnappy decodes a body in the Snappy framing format. Only that
+// format can be streamed; a bare block has no stream identifier and is
+// rejected here rather than reported as corrupt by the reader.
+func decodeSnappy(src io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(src)
+	if header, _ := buffered.Peek(len(snappyStreamIdentifier)); !bytes.Equal(header, snappyStreamIdentifier) {
+		return nil, errors.New("snappy body is not in the framing format; block format is not supported")
+	}
+	return io.NopCloser(snappy.NewReader(buffered)), nil
+}
@@ -0,0 +1,49 @@
+package request_decompressor
+
+import "errors"
+
+// Status describes a provisioned handler, for readiness checks and
+// custom status endpoints.
+type Status struct {
+	// Ready is true once Provision has succeeded.
+	Ready bool `json:"ready"`
+
+	// Encodings lists the built-in encodings the handler will decode,
+	// after encodings and the per-encoding toggles are applied.
+	Encodings []string `json:"encodings"`
+
+	// ZstdDictID is the ID of the loaded zstd dictionary, if any.
+	ZstdDictID uint32 `json:"zstd_dict_id,omitempty"`
+
+	// ActiveDecompressions is the number of bodies being decoded right
+	// now. It is only tracked when max_concurrent is set.
+	ActiveDecompressions int `json:"active_decompressions,omitempty"`
+}
+
+// ErrNotProvisioned is returned by Ready for a handler that hasn't been
+// successfully provisioned.
+var ErrNotProvisioned = errors.New("request_decompress handler is not provisioned")
+
+// Ready reports whether m has been provisioned, with its pools and any
+// zstd dictionary loaded, and can serve requests.
+func (m *Middleware) Ready() error {
+	if !m.provisioned {
+		return ErrNotProvisioned
+	}
+	return nil
+}
+
+// Status returns the current state of m.
+func (m *Middleware) Status() Status {
+	status := Status{
+		Ready:                m.provisioned,
+		ZstdDictID:           m.zstdDictID,
+		ActiveDecompressions: len(m.slots),
+	}
+	for _, encoding := range builtinEncodings {
+		if m.canDecode(encoding) {
+			status.Encodings = append(status.Encodings, encoding)
+		}
+	}
+	return status
+}
@@ -0,0 +1,133 @@
+package request_decompressor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// teeQueueSize is how many bodies may wait for the tee sink. Bodies
+	// that arrive while the queue is full are dropped, so a slow or
+	// unreachable sink never holds up requests.
+	teeQueueSize = 64
+
+	// teeTimeout bounds a single upload to a tee URL.
+	teeTimeout = 10 * time.Second
+)
+
+// teeSink copies decompressed bodies to TeeTo from a background goroutine.
+type teeSink struct {
+	target string
+	file   *os.File
+	client *http.Client
+	logger *zap.Logger
+
+	queue  chan teeBody
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type teeBody struct {
+	contentType string
+	data        []byte
+}
+
+// newTeeSink opens target, which is an http(s) URL or a file path, and
+// starts the goroutine that writes to it.
+func newTeeSink(target string, logger *zap.Logger) (*teeSink, error) {
+	t := &teeSink{
+		target: target,
+		logger: logger,
+		queue:  make(chan teeBody, teeQueueSize),
+	}
+	if isTeeURL(target) {
+		t.client = &http.Client{Timeout: teeTimeout}
+	} else {
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("opening tee_to file: %v", err)
+		}
+		t.file = file
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	go t.run()
+	return t, nil
+}
+
+// isTeeURL reports whether target names an HTTP endpoint rather than a
+// file.
+func isTeeURL(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// send queues data to be written to the sink, or drops it if the queue is
+// full. data must not be modified afterwards.
+func (t *teeSink) send(contentType string, data []byte) {
+	select {
+	case t.queue <- teeBody{contentType: contentType, data: data}:
+	default:
+		t.logger.Warn("tee queue full, dropping decompressed body",
+			zap.String("tee_to", t.target),
+			zap.Int("size", len(data)),
+		)
+	}
+}
+
+func (t *teeSink) run() {
+	for {
+		select {
+		case <-t.ctx.Done():
+			if t.file != nil {
+				t.file.Close()
+			}
+			return
+		case body := <-t.queue:
+			// Uploads cut short by close aren't worth reporting.
+			if err := t.write(body); err != nil && t.ctx.Err() == nil {
+				t.logger.Error("writing decompressed body to tee",
+					zap.String("tee_to", t.target),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// write POSTs body to the tee URL, or appends it to the tee file followed
+// by a newline.
+func (t *teeSink) write(body teeBody) error {
+	if t.file != nil {
+		_, err := t.file.Write(append(body.data[:len(body.data):len(body.data)], '\n'))
+		return err
+	}
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodPost, t.target, bytes.NewReader(body.data))
+	if err != nil {
+		return err
+	}
+	if body.contentType != "" {
+		req.Header.Set("Content-Type", body.contentType)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("tee endpoint responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// close stops the sink. Bodies still queued are dropped.
+func (t *teeSink) close() {
+	t.cancel()
+}
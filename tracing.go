@@ -0,0 +1,38 @@
+package request_decompressor
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/calebcall/request-decompressor"
+
+// startDecodeSpan starts the span covering the decoding of a body. It uses
+// the tracer provider of the span already in ctx, so it nests in the
+// request span of Caddy's tracing handler and is a no-op without one.
+func startDecodeSpan(ctx context.Context, encodings []string) trace.Span {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	_, span := tracer.Start(ctx, "request_decompress",
+		trace.WithAttributes(attribute.String("request_decompress.encoding", strings.Join(encodings, ", "))))
+	return span
+}
+
+// endDecodeSpan records the outcome of a decode on span and ends it.
+func endDecodeSpan(span trace.Span, compressedSize, decompressedSize int64, err error) {
+	span.SetAttributes(
+		attribute.Int64("request_decompress.compressed_size", compressedSize),
+		attribute.Int64("request_decompress.decompressed_size", decompressedSize),
+	)
+	if compressedSize > 0 {
+		span.SetAttributes(attribute.Float64("request_decompress.ratio", float64(decompressedSize)/float64(compressedSize)))
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,21 @@
+//go:build !minimal && !noxz
+
+package request_decompressor
+
+import (
+	"io"
+
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	registerDecoder("xz", func(*Middleware) (decodeFunc, error) {
+		return func(src io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(src)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xr), nil
+		}, nil
+	})
+}
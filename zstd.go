@@ -0,0 +1,121 @@
+//go:build !minimal && !nozstd
+
+package request_decompressor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zstdFrameMagic     = 0xfd2fb528
+	zstdSkippableMagic = 0x184d2a50 // low nibble is user-defined
+)
+
+// zstdDecoderPool is shared by every handler decoding zstd without a
+// dictionary or a ZstdConcurrency of its own.
+var zstdDecoderPool = newZstdPool(1)
+
+func init() {
+	registerDecoder("zstd", newZstdDecoder)
+	registerEncoder("zstd", func(dst io.Writer) (io.WriteCloser, error) {
+		// One encoder per request; concurrency would only add goroutines.
+		return zstd.NewWriter(dst, zstd.WithEncoderConcurrency(1))
+	})
+}
+
+// newZstdDecoder sets up zstd decoding for m, with the dictionary in
+// ZstdDict if there is one and ZstdConcurrency goroutines per decoder.
+func newZstdDecoder(m *Middleware) (decodeFunc, error) {
+	concurrency := max(m.ZstdConcurrency, 1)
+	if m.ZstdDict == "" {
+		if concurrency == 1 {
+			return zstdDecoderPool.get, nil
+		}
+		return newZstdPool(concurrency).get, nil
+	}
+	dict, err := os.ReadFile(m.ZstdDict)
+	if err != nil {
+		return nil, fmt.Errorf("loading zstd dictionary: %v", err)
+	}
+	info, err := zstd.InspectDictionary(dict)
+	if err != nil {
+		return nil, fmt.Errorf("loading zstd dictionary %s: %v", m.ZstdDict, err)
+	}
+	m.zstdDictID = info.ID()
+	pool := newZstdPool(concurrency, zstd.WithDecoderDicts(dict))
+	// Build one decoder up front so a malformed dictionary fails
+	// provisioning instead of every request.
+	decoder, err := zstd.NewReader(nil, pool.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("loading zstd dictionary %s: %v", m.ZstdDict, err)
+	}
+	pool.pool.Put(decoder)
+	return pool.get, nil
+}
+
+// zstdPool pools zstd decoders that share the same options.
+type zstdPool struct {
+	pool sync.Pool
+	opts []zstd.DOption
+}
+
+// newZstdPool returns a pool of decoders created with opts that use up to
+// concurrency goroutines each. With 1 they decode synchronously; with more,
+// a streamed body that the next handler never finishes or closes would
+// leave the decoder's goroutines blocked for good, which is why Stream
+// requires 1.
+func newZstdPool(concurrency int, opts ...zstd.DOption) *zstdPool {
+	return &zstdPool{opts: append([]zstd.DOption{zstd.WithDecoderConcurrency(concurrency)}, opts...)}
+}
+
+// get returns a zstd decoder for src, reusing a pooled one if available.
+// Closing it returns it to the pool rather than shutting the decoder down.
+func (z *zstdPool) get(src io.Reader) (io.ReadCloser, error) {
+	// The decoder only looks at the frame header once it's read from.
+	src, err := checkMagic(src, 4, func(magic []byte) bool {
+		m := binary.LittleEndian.Uint32(magic)
+		return m == zstdFrameMagic || m&0xfffffff0 == zstdSkippableMagic
+	})
+	if err != nil {
+		return nil, err
+	}
+	decoder, ok := z.pool.Get().(*zstd.Decoder)
+	if !ok {
+		if decoder, err = zstd.NewReader(src, z.opts...); err != nil {
+			return nil, err
+		}
+		return &pooledZstdDecoder{Decoder: decoder, pool: z}, nil
+	}
+	if err := decoder.Reset(src); err != nil {
+		decoder.Close()
+		return nil, err
+	}
+	return &pooledZstdDecoder{Decoder: decoder, pool: z}, nil
+}
+
+type pooledZstdDecoder struct {
+	*zstd.Decoder
+	pool *zstdPool
+}
+
+// Close implements io.Closer.
+func (p *pooledZstdDecoder) Close() error {
+	if p.Decoder == nil {
+		return nil
+	}
+	// Resetting to nil stops any stream goroutines and drops the
+	// reference to the request body.
+	if err := p.Decoder.Reset(nil); err != nil {
+		p.Decoder.Close()
+	} else {
+		p.pool.pool.Put(p.Decoder)
+	}
+	p.Decoder = nil
+	return nil
+}